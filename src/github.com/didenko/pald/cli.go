@@ -0,0 +1,198 @@
+/*
+	(c) Copyright 2015 Vlad Didenko
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	    http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/didenko/pald/client"
+)
+
+// Exit codes of the client commands
+const (
+	exitFailure     = 1
+	exitNotFound    = 2
+	exitExhausted   = 3
+	exitUnreachable = 4
+)
+
+// exitError makes main exit with the code
+type exitError struct {
+	code int
+	err  error
+}
+
+func (e *exitError) Error() string {
+	return e.err.Error()
+}
+
+func (e *exitError) Unwrap() error {
+	return e.err
+}
+
+// exitCode tells the failure of a daemon request apart
+func exitCode(err error) error {
+
+	var unreachable net.Error
+
+	switch {
+	case errors.Is(err, client.ErrNotFound):
+		return &exitError{exitNotFound, err}
+	case errors.Is(err, client.ErrExhausted):
+		return &exitError{exitExhausted, err}
+	case errors.As(err, &unreachable):
+		return &exitError{exitUnreachable, err}
+	}
+
+	return &exitError{exitFailure, err}
+}
+
+// newClient returns a client of the running daemon, falling back
+// to the dump file while the daemon is not running
+func newClient(command string) *client.Client {
+
+	c := client.New(daemonURL())
+	c.Agent = daemonName + " " + command
+
+	if storage == "file" {
+		c.Local = &client.Local{
+			DumpFile: dumpName,
+			PortMin:  portMin,
+			PortMax:  portMax,
+		}
+	}
+
+	return c
+}
+
+// clientCommand runs the get, set, del and list commands
+// against the running daemon or, failing that, the dump file
+func clientCommand(command string, args []string) (string, error) {
+
+	usage := map[string]string{
+		"get":  "get [--json] <name>",
+		"set":  "set [--json] <name>",
+		"del":  "del <name|port>",
+		"list": "list [--json]",
+	}[command]
+	usage = "Usage: " + daemonName + " " + usage
+
+	flags := flag.NewFlagSet(command, flag.ContinueOnError)
+	asJSON := flags.Bool("json", false, "print JSON")
+	if err := flags.Parse(args); err != nil {
+		return usage, &exitError{exitFailure, err}
+	}
+
+	wantArgs := 1
+	if command == "list" {
+		wantArgs = 0
+	}
+	if flags.NArg() != wantArgs {
+		return usage, &exitError{exitFailure, fmt.Errorf("Expected %d argument(s), got %d", wantArgs, flags.NArg())}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	c := newClient(command)
+
+	var (
+		port uint16
+		err  error
+	)
+
+	switch command {
+
+	case "get", "set":
+		if command == "get" {
+			port, err = c.Get(ctx, flags.Arg(0))
+		} else {
+			port, err = c.Set(ctx, flags.Arg(0))
+		}
+		if err != nil {
+			return "Failed to " + command + " the port", exitCode(err)
+		}
+		if *asJSON {
+			return jsonText(client.Entry{Name: flags.Arg(0), Port: port})
+		}
+		return strconv.Itoa(int(port)), nil
+
+	case "del":
+		if p, perr := strconv.ParseUint(flags.Arg(0), 10, 16); perr == nil {
+			err = c.Release(ctx, uint16(p))
+		} else {
+			err = c.ReleaseName(ctx, flags.Arg(0))
+		}
+		if err != nil {
+			return "Failed to release the port", exitCode(err)
+		}
+		return "", nil
+
+	default:
+		list, err := c.List(ctx)
+		if err != nil {
+			return "Failed to list the services", exitCode(err)
+		}
+		if *asJSON {
+			return jsonText(list)
+		}
+		return table(list), nil
+	}
+}
+
+func jsonText(v interface{}) (string, error) {
+	text, err := json.Marshal(v)
+	return string(text), err
+}
+
+// table formats the services for humans, or as tab separated
+// lines if the stdout is not a terminal
+func table(list []client.Entry) string {
+
+	var b strings.Builder
+
+	if !isTerminal(os.Stdout) {
+		for _, e := range list {
+			fmt.Fprintf(&b, "%s\t%d\t%s\n", e.Name, e.Port, strings.Join(e.Addr, ","))
+		}
+		return strings.TrimSuffix(b.String(), "\n")
+	}
+
+	w := tabwriter.NewWriter(&b, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "SERVICE\tPORT\tADDRESSES")
+	for _, e := range list {
+		fmt.Fprintf(w, "%s\t%d\t%s\n", e.Name, e.Port, strings.Join(e.Addr, ","))
+	}
+	w.Flush()
+
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
@@ -0,0 +1,473 @@
+/*
+	(c) Copyright 2015 Vlad Didenko
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	    http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+// Package client talks to a running pald daemon over its HTTP interface.
+//
+//	c, err := client.Discover()
+//	if err != nil {
+//		return err
+//	}
+//	port, err := c.Ensure(ctx, "my-service")
+package client
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/didenko/pald/internal/platform"
+	"github.com/didenko/pald/internal/registry"
+	"github.com/didenko/viper"
+)
+
+// Errors matched by the *Error values with errors.Is
+var (
+	ErrNotFound    = errors.New("Service not found")
+	ErrTaken       = errors.New("Service name is already taken")
+	ErrExhausted   = errors.New("No ports available")
+	ErrVetoed      = errors.New("Allocation vetoed by a hook")
+	ErrBadRequest  = errors.New("Bad request")
+	ErrUnavailable = errors.New("Registry is not available")
+)
+
+// Error is a failed response from the daemon
+type Error struct {
+	Status  int
+	Message string
+	kind    error
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s (HTTP %d): %s", e.kind, e.Status, e.Message)
+}
+
+// Unwrap returns the Err value of the failure
+func (e *Error) Unwrap() error {
+	return e.kind
+}
+
+// Entry is a registered service
+type Entry struct {
+	Name string   `json:"name"`
+	Port uint16   `json:"port"`
+	Addr []string `json:"addr,omitempty"`
+}
+
+// Client makes requests to a daemon. Its fields must
+// not be changed while requests are being made.
+type Client struct {
+
+	// BaseURL is the daemon address, like http://localhost:49200
+	BaseURL string
+
+	// HTTP makes the requests, http.DefaultClient if nil
+	HTTP *http.Client
+
+	// Retries is how many times to retry a request which failed to
+	// connect or found the registry unavailable. Failed lookups,
+	// releases and listings are also retried on other network errors.
+	Retries int
+
+	// Backoff is the delay before the first retry,
+	// doubled for every next one
+	Backoff time.Duration
+
+	// Agent is sent in the X-Pald-Client header to get
+	// into the daemon's audit trail, if not empty
+	Agent string
+
+	// Local, if not nil, serves the requests from the dump file
+	// when the daemon is not running
+	Local *Local
+}
+
+// The daemon settings if not configured
+const (
+	DefaultListen  = 49200
+	DefaultPortMin = 49201
+	DefaultPortMax = 49999
+)
+
+// New returns a client of the daemon at the base URL
+func New(baseURL string) *Client {
+	return &Client{
+		BaseURL: strings.TrimSuffix(baseURL, "/"),
+		Retries: 3,
+		Backoff: 100 * time.Millisecond,
+	}
+}
+
+// Discover returns a client of the local daemon. The address is
+// taken from the PALD_URL environment variable, if set, or else
+// the port_listen setting in the pald config file, searched in
+// the same locations as the daemon does, unless given by the
+// PALD_CONFIG environment variable. The PALD_* variables override
+// the settings as they do for the daemon. In the latter case, unless
+// the daemon is configured with another storage, the client falls
+// back to the configured dump_file while the daemon is not running.
+func Discover() (*Client, error) {
+
+	if u := os.Getenv("PALD_URL"); u != "" {
+		if _, err := url.Parse(u); err != nil {
+			return nil, fmt.Errorf("PALD_URL %q is not a URL: %s", u, err)
+		}
+		return New(u), nil
+	}
+
+	dirs := platform.GetConfigFor("pald")
+
+	v := viper.New()
+	v.AddConfigPath(dirs.DirSystem())
+	v.AddConfigPath(dirs.DirUser())
+	v.SetConfigName("config")
+	v.SetConfigFile(os.Getenv("PALD_CONFIG"))
+	v.SetEnvPrefix("pald")
+	v.AutomaticEnv()
+	v.SetDefault("port_listen", DefaultListen)
+	v.SetDefault("port_min", DefaultPortMin)
+	v.SetDefault("port_max", DefaultPortMax)
+	v.SetDefault("dump_file", path.Join(dirs.DirUser(), "dump"))
+	v.SetDefault("storage", "file")
+
+	// A missing config file leaves the defaults
+	v.ReadInConfig()
+
+	port := v.GetInt("port_listen")
+	if port <= 0 || port > 65535 {
+		return nil, fmt.Errorf("Configured port_listen %d is not a port number", port)
+	}
+
+	c := New(fmt.Sprintf("http://localhost:%d", port))
+
+	min, max := v.GetInt("port_min"), v.GetInt("port_max")
+	if v.GetString("storage") == "file" && 0 < min && min <= max && max <= 65535 {
+		c.Local = &Local{
+			DumpFile: v.GetString("dump_file"),
+			PortMin:  uint16(min),
+			PortMax:  uint16(max),
+		}
+	}
+
+	return c, nil
+}
+
+// Get returns the port registered to the service
+func (c *Client) Get(ctx context.Context, name string) (uint16, error) {
+	port, err := c.port(c.call(ctx, "/get", url.Values{"service": {name}}, true))
+	if c.daemonless(err) {
+		return c.Local.Get(ctx, name)
+	}
+	return port, err
+}
+
+// Set allocates a port to the service
+func (c *Client) Set(ctx context.Context, name string) (uint16, error) {
+	port, err := c.port(c.call(ctx, "/set", url.Values{"service": {name}}, false))
+	if c.daemonless(err) {
+		return c.Local.Set(ctx, name)
+	}
+	return port, err
+}
+
+// Ensure returns the port registered to the service,
+// allocating one if there is none
+func (c *Client) Ensure(ctx context.Context, name string) (uint16, error) {
+	port, _, err := c.EnsureAllocated(ctx, name)
+	return port, err
+}
+
+// EnsureAllocated is Ensure also telling if the port was allocated
+// by the call, rather than registered before or by someone else
+func (c *Client) EnsureAllocated(ctx context.Context, name string) (uint16, bool, error) {
+
+	port, err := c.Get(ctx, name)
+	if !errors.Is(err, ErrNotFound) {
+		return port, false, err
+	}
+
+	port, err = c.Set(ctx, name)
+	if errors.Is(err, ErrTaken) {
+		// Allocated by someone else meanwhile
+		port, err = c.Get(ctx, name)
+		return port, false, err
+	}
+
+	return port, err == nil, err
+}
+
+// Release frees the port. Releasing a free port is not an error.
+func (c *Client) Release(ctx context.Context, port uint16) error {
+	body, err := c.call(ctx, "/del", url.Values{"port": {strconv.Itoa(int(port))}}, true)
+	if c.daemonless(err) {
+		return c.Local.Release(ctx, port)
+	}
+	if err == nil {
+		body.Close()
+	}
+	return err
+}
+
+// ReleaseName frees the port of the service. It fails with
+// ErrNotFound if the service has no port.
+func (c *Client) ReleaseName(ctx context.Context, name string) error {
+
+	port, err := c.Get(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	return c.Release(ctx, port)
+}
+
+// List returns all the registered services ordered by port
+func (c *Client) List(ctx context.Context) ([]Entry, error) {
+
+	body, err := c.call(ctx, "/export", url.Values{"format": {"json"}}, true)
+	if c.daemonless(err) {
+		return c.Local.List(ctx)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	var list []Entry
+	if err = json.NewDecoder(body).Decode(&list); err != nil {
+		return nil, fmt.Errorf("Unexpected service list: %s", err)
+	}
+
+	return list, nil
+}
+
+// daemonless tells if the request failed for the daemon
+// not running and should be served by Local
+func (c *Client) daemonless(err error) bool {
+	return c.Local != nil && errors.Is(err, syscall.ECONNREFUSED)
+}
+
+// port parses a port number response
+func (c *Client) port(body io.ReadCloser, err error) (uint16, error) {
+
+	if err != nil {
+		return 0, err
+	}
+	defer body.Close()
+
+	text, err := ioutil.ReadAll(body)
+	if err != nil {
+		return 0, err
+	}
+
+	port, err := strconv.ParseUint(strings.TrimSpace(string(text)), 10, 16)
+	if err != nil {
+		return 0, fmt.Errorf("Unexpected port number %q", text)
+	}
+
+	return uint16(port), nil
+}
+
+// call makes a request, retrying as configured, and
+// returns the body of a successful response
+func (c *Client) call(ctx context.Context, path string, params url.Values, idempotent bool) (io.ReadCloser, error) {
+
+	backoff := c.Backoff
+
+	for attempt := 0; ; attempt++ {
+
+		body, err := c.once(ctx, path, params)
+		if err == nil {
+			return body, nil
+		}
+
+		var failed *Error
+		retry := errors.Is(err, syscall.ECONNREFUSED) ||
+			errors.As(err, &failed) && failed.kind == ErrUnavailable ||
+			idempotent && failed == nil
+
+		if c.daemonless(err) {
+			// Not worth waiting for, the dump file can be used instead
+			retry = false
+		}
+
+		if !retry || attempt >= c.Retries || ctx.Err() != nil {
+			return nil, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+func (c *Client) once(ctx context.Context, path string, params url.Values) (io.ReadCloser, error) {
+
+	method := "GET"
+	if path == "/set" || path == "/del" {
+		method = "POST"
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.BaseURL+path+"?"+params.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.Agent != "" {
+		req.Header.Set("X-Pald-Client", c.Agent)
+	}
+
+	hc := c.HTTP
+	if hc == nil {
+		hc = http.DefaultClient
+	}
+
+	resp, err := hc.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode == http.StatusOK {
+		return resp.Body, nil
+	}
+
+	defer resp.Body.Close()
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+
+	failure := &Error{Status: resp.StatusCode, Message: strings.TrimSpace(string(msg))}
+
+	switch resp.StatusCode {
+	case http.StatusNotFound:
+		failure.kind = ErrNotFound
+	case http.StatusPreconditionFailed:
+		failure.kind = ErrTaken
+		if failure.Message == registry.ErrNoPorts.Error() {
+			failure.kind = ErrExhausted
+		}
+	case http.StatusForbidden:
+		failure.kind = ErrVetoed
+	case http.StatusBadRequest:
+		failure.kind = ErrBadRequest
+	case http.StatusServiceUnavailable:
+		failure.kind = ErrUnavailable
+	default:
+		failure.kind = fmt.Errorf("Unexpected response")
+	}
+
+	return nil, failure
+}
+
+// Event is a registry change streamed by Watch. Type is alloc,
+// release, watermark, or reset if the events since the resume
+// point are lost and the registry should be fetched anew.
+type Event struct {
+	ID      string    `json:"id"`
+	Type    string    `json:"type"`
+	Service string    `json:"service,omitempty"`
+	Port    uint16    `json:"port,omitempty"`
+	Addr    []string  `json:"addr,omitempty"`
+	Time    time.Time `json:"time"`
+}
+
+// Watch calls fn with the registry changes as they happen, starting
+// after the event with the since ID, if not empty. It returns when
+// the context is done or the connection fails; to resume, call it
+// again with the ID of the last event received.
+func (c *Client) Watch(ctx context.Context, since string, fn func(Event)) error {
+	return c.WatchOpened(ctx, since, nil, fn)
+}
+
+// WatchOpened is Watch calling opened, if not nil, once the stream is
+// open, so that the state fetched then misses none of the later changes
+func (c *Client) WatchOpened(ctx context.Context, since string, opened func(), fn func(Event)) error {
+
+	req, err := http.NewRequestWithContext(ctx, "GET", c.BaseURL+"/watch", nil)
+	if err != nil {
+		return err
+	}
+	if since != "" {
+		req.Header.Set("Last-Event-ID", since)
+	}
+
+	hc := c.HTTP
+	if hc == nil {
+		hc = http.DefaultClient
+	}
+
+	resp, err := hc.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return &Error{Status: resp.StatusCode, Message: resp.Status, kind: fmt.Errorf("Unexpected response")}
+	}
+
+	if opened != nil {
+		opened()
+	}
+
+	var (
+		ev    Event
+		data  string
+		lines = bufio.NewScanner(resp.Body)
+	)
+
+	for lines.Scan() {
+
+		line := lines.Text()
+
+		switch {
+		case line == "":
+			if ev.Type != "" {
+				if data != "" && ev.Type != "reset" {
+					json.Unmarshal([]byte(data), &ev)
+				}
+				fn(ev)
+			}
+			ev, data = Event{}, ""
+		case strings.HasPrefix(line, "id: "):
+			ev.ID = line[4:]
+		case strings.HasPrefix(line, "event: "):
+			ev.Type = line[7:]
+		case strings.HasPrefix(line, "data: "):
+			data = line[6:]
+		}
+	}
+
+	if err = lines.Err(); err == nil {
+		err = io.ErrUnexpectedEOF
+	}
+	if ctx.Err() != nil {
+		err = ctx.Err()
+	}
+
+	return err
+}
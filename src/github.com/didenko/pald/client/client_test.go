@@ -0,0 +1,250 @@
+/*
+	(c) Copyright 2015 Vlad Didenko
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	    http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package client
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/didenko/pald/internal/persist"
+	"github.com/didenko/pald/internal/server"
+)
+
+// startServer runs a server of the test's own on a free port,
+// with an empty registry of two ports, and returns its URL
+func startServer(t *testing.T) string {
+
+	store, err := persist.OpenFile(filepath.Join(t.TempDir(), "dump"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ln, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+
+	go server.Run(server.Config{
+		Listen:   uint16(port),
+		PortMin:  49300,
+		PortMax:  49301,
+		Store:    store,
+		Throttle: time.Second,
+	})
+
+	addr := "localhost:" + strconv.Itoa(port)
+
+	for i := 0; i < 50; i++ {
+		if conn, err := net.Dial("tcp", addr); err == nil {
+			conn.Close()
+			return "http://" + addr
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatal("The test server failed to start listening")
+	return ""
+}
+
+func TestClient(t *testing.T) {
+
+	url := startServer(t)
+
+	ctx := context.Background()
+	c := New(url + "/")
+
+	expect := func(op string, port uint16, err error, wantPort uint16, wantErr error) {
+		t.Helper()
+		if port != wantPort || !errors.Is(err, wantErr) {
+			t.Errorf("%s returned %d, %v instead of %d, %v", op, port, err, wantPort, wantErr)
+		}
+	}
+
+	port, err := c.Get(ctx, "a")
+	expect("Get of a missing service", port, err, 0, ErrNotFound)
+
+	port, err = c.Set(ctx, "a")
+	expect("Set", port, err, 49300, nil)
+
+	port, err = c.Set(ctx, "a")
+	expect("Set of a taken name", port, err, 0, ErrTaken)
+
+	port, err = c.Ensure(ctx, "a")
+	expect("Ensure of a registered service", port, err, 49300, nil)
+
+	port, fresh, err := c.EnsureAllocated(ctx, "b")
+	expect("Ensure of a new service", port, err, 49301, nil)
+	if !fresh {
+		t.Error("Ensure of a new service should tell it allocated the port")
+	}
+
+	if _, fresh, _ = c.EnsureAllocated(ctx, "b"); fresh {
+		t.Error("Ensure of a registered service should tell it allocated nothing")
+	}
+
+	port, err = c.Set(ctx, "c")
+	expect("Set in an exhausted range", port, err, 0, ErrExhausted)
+
+	port, err = c.Set(ctx, "")
+	expect("Set without a name", port, err, 0, ErrBadRequest)
+
+	list, err := c.List(ctx)
+	if err != nil || len(list) != 2 || list[0].Name != "a" || list[1].Port != 49301 {
+		t.Errorf("List returned %v, %v", list, err)
+	}
+
+	if err = c.ReleaseName(ctx, "a"); err != nil {
+		t.Error(err)
+	}
+	if err = c.ReleaseName(ctx, "a"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Releasing a missing service returned %v", err)
+	}
+	if err = c.Release(ctx, 49301); err != nil {
+		t.Error(err)
+	}
+	if list, _ = c.List(ctx); len(list) != 0 {
+		t.Errorf("Services left after releasing all: %v", list)
+	}
+}
+
+func TestRetry(t *testing.T) {
+
+	c := New("http://localhost:8102")
+	c.Retries = 2
+	c.Backoff = 10 * time.Millisecond
+
+	start := time.Now()
+	_, err := c.Get(context.Background(), "a")
+
+	if err == nil || time.Since(start) < 30*time.Millisecond {
+		t.Errorf("Expected a failure after retrying, got %v in %s", err, time.Since(start))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err = c.Get(ctx, "a"); !errors.Is(err, context.Canceled) {
+		t.Errorf("A cancelled request returned %v", err)
+	}
+}
+
+func TestDiscover(t *testing.T) {
+
+	os.Setenv("PALD_URL", "http://localhost:8103")
+	defer os.Unsetenv("PALD_URL")
+
+	c, err := Discover()
+	if err != nil || c.BaseURL != "http://localhost:8103" {
+		t.Errorf("Discover returned %+v, %v", c, err)
+	}
+}
+
+func TestLocal(t *testing.T) {
+
+	name := "./local.test"
+	defer os.Remove(name)
+	defer os.Remove(name + ".lock")
+
+	c := New("http://localhost:8104")
+	c.Local = &Local{DumpFile: name, PortMin: 49400, PortMax: 49401}
+
+	ctx := context.Background()
+
+	if _, err := c.Get(ctx, "a"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Looking up in a missing dump file returned %v", err)
+	}
+
+	for i, svc := range []string{"a", "b"} {
+		if port, err := c.Set(ctx, svc); err != nil || port != 49400+uint16(i) {
+			t.Errorf("Allocating %q returned %d, %v", svc, port, err)
+		}
+	}
+
+	if _, err := c.Set(ctx, "c"); !errors.Is(err, ErrExhausted) {
+		t.Errorf("Allocating from a full range returned %v", err)
+	}
+
+	if err := c.ReleaseName(ctx, "a"); err != nil {
+		t.Error(err)
+	}
+
+	dump, err := ioutil.ReadFile(name)
+	if err != nil || string(dump) != "b\t49401\t\n" {
+		t.Errorf("Unexpected dump file %q, %v", dump, err)
+	}
+
+	list, err := c.List(ctx)
+	if err != nil || len(list) != 1 || list[0].Name != "b" {
+		t.Errorf("Listing returned %v, %v", list, err)
+	}
+}
+
+func TestWatch(t *testing.T) {
+
+	url := startServer(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	c := New(url)
+	got := make(chan Event, 10)
+
+	opened := make(chan struct{})
+	go c.WatchOpened(ctx, "", func() { close(opened) }, func(ev Event) { got <- ev })
+
+	select {
+	case <-opened:
+	case <-time.After(5 * time.Second):
+		t.Fatal("The watch stream did not open")
+	}
+
+	c.Set(ctx, "w")
+
+	select {
+	case ev := <-got:
+		if ev.Type != "alloc" || ev.Service != "w" || ev.Port != 49300 || ev.ID == "" {
+			t.Errorf("Unexpected event %+v", ev)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("No event received")
+	}
+
+	c.ReleaseName(ctx, "w")
+	<-got
+	cancel()
+
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err := c.Watch(ctx, "stale-1", func(ev Event) {
+		if ev.Type != "reset" {
+			t.Errorf("Resuming from a stale ID got %+v", ev)
+		}
+		cancel()
+	})
+	if err != context.Canceled {
+		t.Errorf("Watch returned %v instead of the cancellation", err)
+	}
+}
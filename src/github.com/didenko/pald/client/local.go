@@ -0,0 +1,179 @@
+/*
+	(c) Copyright 2015 Vlad Didenko
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	    http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/didenko/pald/internal/lock"
+	"github.com/didenko/pald/internal/registry"
+)
+
+// Local operates on the dump file directly while the daemon is
+// not running. Every operation takes the same exclusive lock on
+// the file the daemon holds while running, so several processes
+// can share the dump file safely without the daemon.
+//
+// The daemon's hooks, webhooks and audit trail are not involved.
+type Local struct {
+
+	// DumpFile is the registry dump, the daemon's dump_file
+	DumpFile string
+
+	// PortMin and PortMax are the allocation range
+	PortMin uint16
+	PortMax uint16
+
+	// LockTimeout limits waiting for the lock, 10 seconds if zero
+	LockTimeout time.Duration
+}
+
+// Get returns the port registered to the service
+func (l *Local) Get(ctx context.Context, name string) (uint16, error) {
+
+	var port uint16
+
+	err := l.update(ctx, false, func(reg *registry.Registry) error {
+		var err error
+		if port, _, err = reg.Lookup(name); err != nil {
+			return fmt.Errorf("%w: %s", ErrNotFound, err)
+		}
+		return nil
+	})
+
+	return port, err
+}
+
+// Set allocates a port to the service
+func (l *Local) Set(ctx context.Context, name string) (uint16, error) {
+
+	var port uint16
+
+	err := l.update(ctx, true, func(reg *registry.Registry) error {
+		var err error
+		port, err = reg.Alloc(name)
+		switch {
+		case err == registry.ErrNoPorts:
+			return fmt.Errorf("%w: %s", ErrExhausted, err)
+		case err != nil:
+			return fmt.Errorf("%w: %s", ErrTaken, err)
+		}
+		return nil
+	})
+
+	return port, err
+}
+
+// Release frees the port. Releasing a free port is not an error.
+func (l *Local) Release(ctx context.Context, port uint16) error {
+	return l.update(ctx, true, func(reg *registry.Registry) error {
+		reg.Forget(port)
+		return nil
+	})
+}
+
+// List returns all the registered services ordered by port
+func (l *Local) List(ctx context.Context) ([]Entry, error) {
+
+	var list []Entry
+
+	err := l.update(ctx, false, func(reg *registry.Registry) error {
+		for _, e := range reg.List() {
+			list = append(list, Entry(e))
+		}
+		return nil
+	})
+
+	return list, err
+}
+
+// update loads the dump file under the lock, calls fn and,
+// if asked to and fn succeeds, writes the registry back
+func (l *Local) update(ctx context.Context, write bool, fn func(*registry.Registry) error) error {
+
+	timeout := l.LockTimeout
+	if timeout == 0 {
+		timeout = 10 * time.Second
+	}
+
+	lockCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	guard, err := lock.Wait(lockCtx, l.DumpFile+".lock")
+	if err != nil {
+		return err
+	}
+	defer guard.Release()
+
+	reg, err := registry.New(l.PortMin, l.PortMax)
+	if err != nil {
+		return err
+	}
+
+	dump, err := os.Open(l.DumpFile)
+	switch {
+	case err == nil:
+		err = reg.Load(dump)
+		dump.Close()
+		if err != nil {
+			return fmt.Errorf("Failed to load %s: %s", l.DumpFile, err)
+		}
+	case !errors.Is(err, os.ErrNotExist):
+		return err
+	}
+
+	if err = fn(reg); err != nil || !write {
+		return err
+	}
+
+	return l.save(reg)
+}
+
+// save replaces the dump file, so that a crash
+// leaves either the old or the new state
+func (l *Local) save(reg *registry.Registry) error {
+
+	tmp, err := ioutil.TempFile(filepath.Dir(l.DumpFile), "."+filepath.Base(l.DumpFile)+".")
+	if err != nil {
+		return err
+	}
+
+	_, err = reg.Dump(tmp)
+	if err == nil {
+		err = tmp.Chmod(0660)
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), l.DumpFile)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+
+	return err
+}
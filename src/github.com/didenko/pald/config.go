@@ -0,0 +1,380 @@
+/*
+	(c) Copyright 2015 Vlad Didenko
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	    http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/didenko/pald/internal/logging"
+	"github.com/didenko/pald/internal/registry"
+	"github.com/didenko/pald/internal/webhook"
+	"github.com/didenko/viper"
+)
+
+// configKeys are all the known settings
+var configKeys = []string{
+	"access_log",
+	"audit_file",
+	"audit_keep",
+	"audit_max_size",
+	"config_watch",
+	"dns_listen",
+	"dns_ttl",
+	"dns_zone",
+	"dump_file",
+	"grpc_listen",
+	"hook_post_alloc",
+	"hook_post_release",
+	"hook_pre_alloc",
+	"hook_pre_release",
+	"hook_timeout",
+	"kv_file",
+	"line_listen",
+	"load_policy",
+	"log_file",
+	"log_format",
+	"log_level",
+	"port_listen",
+	"port_max",
+	"port_min",
+	"range_policy",
+	"ready_fail_exhausted",
+	"storage",
+	"watermarks",
+	"webhook_queue",
+	"webhook_retries",
+	"webhook_timeout",
+	"webhooks",
+}
+
+// configCommand runs the config check and config show commands
+func configCommand(args []string) (string, error) {
+
+	usage := "Usage: " + daemonName + " config check | show"
+
+	if len(args) != 1 {
+		return usage, fmt.Errorf("Expected 1 argument, got %d", len(args))
+	}
+
+	fileErr := readConfigFile()
+
+	switch args[0] {
+
+	case "check":
+		var problems []string
+		if fileErr != nil {
+			problems = append(problems, fmt.Sprintf("Failed to read the config file %s: %s", configFile, fileErr))
+		}
+		problems = append(problems, checkConfig()...)
+
+		for _, p := range problems {
+			fmt.Println(p)
+		}
+
+		if len(problems) > 0 {
+			return "", fmt.Errorf("%d problem(s) found in the configuration", len(problems))
+		}
+
+		if configFile == "" {
+			return "The configuration is valid, no config file is used", nil
+		}
+		return fmt.Sprintf("The configuration in %s is valid", configFile), nil
+
+	case "show":
+		if fileErr != nil {
+			return "Failed to read the config file " + configFile, fileErr
+		}
+		return showConfig(), nil
+	}
+
+	return usage, fmt.Errorf("Unknown config command %q", args[0])
+}
+
+// searchConfig returns the first config file found in the
+// system-wide, user-specific and working directories, or
+// an empty string if there is none
+func searchConfig() string {
+
+	wd, _ := os.Getwd()
+
+	for _, dir := range []string{platformConfig.DirSystem(), platformConfig.DirUser(), wd} {
+		for _, ext := range viper.SupportedExts {
+			name := filepath.Join(dir, "config."+ext)
+			if info, err := os.Stat(name); err == nil && info.Mode().IsRegular() {
+				return name
+			}
+		}
+	}
+
+	return ""
+}
+
+// readConfigFile reads the config file, if there is one
+func readConfigFile() error {
+
+	// Searched anew on every reload until there is one
+	configFile = configFlag
+	if configFile == "" {
+		configFile = searchConfig()
+	}
+
+	if configFile == "" {
+		return nil
+	}
+
+	viper.SetConfigFile(configFile)
+	return viper.ReadInConfig()
+}
+
+// checkConfig returns all the problems of the settings
+func checkConfig() []string {
+
+	var problems []string
+	problem := func(format string, a ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, a...))
+	}
+
+	ports := make(map[string]int)
+	for _, key := range []string{"port_min", "port_max", "port_listen"} {
+		port, err := strconv.Atoi(viper.GetString(key))
+		if err != nil || port < 1 || port > 65535 {
+			problem("Setting %s = %v is not a port number", key, viper.Get(key))
+			continue
+		}
+		ports[key] = port
+	}
+
+	min, okMin := ports["port_min"]
+	max, okMax := ports["port_max"]
+	if okMin && okMax {
+		if min > max {
+			problem("Setting port_min = %d is above port_max = %d", min, max)
+		} else if listen, ok := ports["port_listen"]; ok && min <= listen && listen <= max {
+			problem("Setting port_listen = %d is inside the allocation range %d-%d", listen, min, max)
+		}
+	}
+
+	checkListen(problem, "grpc_listen")
+	checkListen(problem, "line_listen")
+
+	if addr := viper.GetString("dns_listen"); addr != "" {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			problem("Setting dns_listen = %q is not host:port: %s", addr, err)
+		}
+	}
+
+	for _, label := range strings.Split(strings.TrimSuffix(viper.GetString("dns_zone"), "."), ".") {
+		if len(label) == 0 || len(label) > 63 {
+			problem("Setting dns_zone = %q is not a domain name", viper.GetString("dns_zone"))
+			break
+		}
+	}
+
+	storage := viper.GetString("storage")
+	switch storage {
+	case "file":
+		checkDir(problem, "dump_file", viper.GetString("dump_file"))
+	case "kv":
+		checkDir(problem, "kv_file", viper.GetString("kv_file"))
+	default:
+		problem("Setting storage = %q is neither file nor kv", storage)
+	}
+
+	if _, err := registry.ParseLoadPolicy(viper.GetString("load_policy")); err != nil {
+		problem("Setting load_policy: %s", err)
+	}
+	if _, err := registry.ParseRangePolicy(viper.GetString("range_policy")); err != nil {
+		problem("Setting range_policy: %s", err)
+	}
+
+	for _, key := range []string{"config_watch", "dns_ttl", "webhook_timeout", "hook_timeout"} {
+		if !isDuration(viper.GetString(key)) {
+			problem("Setting %s = %q is not a duration", key, viper.GetString(key))
+		}
+	}
+
+	if err := logging.Validate(viper.GetString("log_format"), viper.GetString("log_level")); err != nil {
+		problem("Setting log_format or log_level: %s", err)
+	}
+	if dest := viper.GetString("log_file"); dest != "" && dest != "stderr" && dest != "stdout" {
+		checkDir(problem, "log_file", dest)
+	}
+
+	if name := viper.GetString("audit_file"); name != "" {
+		checkDir(problem, "audit_file", name)
+	}
+
+	for _, key := range []string{"audit_max_size", "audit_keep", "webhook_queue", "webhook_retries"} {
+		if n, err := strconv.Atoi(viper.GetString(key)); err != nil || n < 0 {
+			problem("Setting %s = %v is not a non-negative integer", key, viper.Get(key))
+		}
+	}
+
+	for _, wm := range watermarkSettings() {
+		percent, err := strconv.Atoi(wm)
+		if err != nil || percent < 1 || percent > 100 {
+			problem("Watermark %q is not a percentage from 1 to 100", wm)
+		}
+	}
+
+	var targets []webhook.Target
+	if err := viper.MarshalKey("webhooks", &targets); err != nil {
+		problem("Setting webhooks: %s", err)
+	}
+	for _, t := range targets {
+		if err := t.Validate(); err != nil {
+			problem("%s", err)
+		}
+	}
+
+	known := make(map[string]bool, len(configKeys))
+	for _, key := range configKeys {
+		known[key] = true
+	}
+	unknown := viper.AllKeys()
+	sort.Strings(unknown)
+	for _, key := range unknown {
+		if !known[key] && viper.InConfig(key) {
+			problem("Setting %s in the config file is unknown", key)
+		}
+	}
+
+	return problems
+}
+
+// checkDir reports a missing directory of the file in the setting
+func checkDir(problem func(string, ...interface{}), key, name string) {
+
+	dir := filepath.Dir(name)
+
+	info, err := os.Stat(dir)
+	switch {
+	case err != nil:
+		problem("Setting %s: directory %s does not exist", key, dir)
+	case !info.IsDir():
+		problem("Setting %s: %s is not a directory", key, dir)
+	}
+}
+
+// checkListen reports the listener address setting which is
+// neither empty, a unix:/path socket, a host:port nor a port
+func checkListen(problem func(string, ...interface{}), key string) {
+
+	addr := viper.GetString(key)
+
+	if strings.HasPrefix(addr, "unix:") {
+		checkDir(problem, key, strings.TrimPrefix(addr, "unix:"))
+		return
+	}
+
+	if addr == "" {
+		return
+	}
+
+	port, err := strconv.Atoi(addr)
+	if err != nil {
+		_, _, err = net.SplitHostPort(addr)
+	} else if port < 1 || port > 65535 {
+		err = fmt.Errorf("%d is not a port number", port)
+	}
+	if err != nil {
+		problem("Setting %s = %q is neither unix:/path, host:port nor a port: %s", key, addr, err)
+	}
+}
+
+// isDuration tells if the value is a duration
+// or a number of nanoseconds
+func isDuration(value string) bool {
+
+	if d, err := time.ParseDuration(value); err == nil {
+		return d >= 0
+	}
+
+	n, err := strconv.ParseInt(value, 10, 64)
+	return err == nil && n >= 0
+}
+
+// watermarkSettings returns the watermarks split from
+// the list or the comma separated values
+func watermarkSettings() []string {
+
+	var percents []string
+	for _, wm := range viper.GetStringSlice("watermarks") {
+		for _, p := range strings.Split(wm, ",") {
+			if p = strings.TrimSpace(p); p != "" {
+				percents = append(percents, p)
+			}
+		}
+	}
+
+	return percents
+}
+
+// showConfig lists the effective settings and their sources
+func showConfig() string {
+
+	var out strings.Builder
+
+	tw := tabwriter.NewWriter(&out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "KEY\tVALUE\tSOURCE")
+
+	for _, key := range configKeys {
+		value := viper.Get(key)
+		if value == nil {
+			value = ""
+		}
+		fmt.Fprintf(tw, "%s\t%v\t%s\n", key, value, configSource(key))
+	}
+
+	tw.Flush()
+
+	return strings.TrimSuffix(out.String(), "\n")
+}
+
+// configSource tells where the effective value of the setting
+// comes from, in the order of precedence
+func configSource(key string) string {
+
+	if flag, ok := flagged[key]; ok {
+		return "flag " + flag
+	}
+
+	env := strings.ToUpper(daemonName + "_" + key)
+	if os.Getenv(env) != "" {
+		return "env " + env
+	}
+
+	if configFile != "" && viper.InConfig(key) {
+		switch filepath.Dir(configFile) {
+		case filepath.Clean(platformConfig.DirSystem()):
+			return "system file " + configFile
+		case filepath.Clean(platformConfig.DirUser()):
+			return "user file " + configFile
+		}
+		return "file " + configFile
+	}
+
+	return "default"
+}
@@ -0,0 +1,166 @@
+/*
+	(c) Copyright 2015 Vlad Didenko
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	    http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// portFlags collects the repeated --port NAME[=ENVVAR] flags
+type portFlags []portFlag
+
+type portFlag struct {
+	name, env string
+}
+
+func (pf *portFlags) String() string {
+	return fmt.Sprint(*pf)
+}
+
+func (pf *portFlags) Set(value string) error {
+
+	name, env, _ := strings.Cut(value, "=")
+	if name == "" {
+		return errors.New("The service name is empty")
+	}
+	if env == "" {
+		env = envName(name)
+	}
+
+	*pf = append(*pf, portFlag{name, env})
+	return nil
+}
+
+// envName turns a service name into NAME_PORT
+func envName(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		}
+		return '_'
+	}, name) + "_PORT"
+}
+
+// execCommand allocates the ports, runs the command with them in
+// its environment, and releases the ports allocated for it after
+// the command exits
+func execCommand(args []string) (string, error) {
+
+	usage := "Usage: " + daemonName + " exec [--keep] --port NAME[=ENVVAR]... -- command [args]"
+
+	var ports portFlags
+
+	flags := flag.NewFlagSet("exec", flag.ContinueOnError)
+	flags.Var(&ports, "port", "a service to allocate a port for, and optionally the variable to export it in, NAME_PORT by default")
+	keep := flags.Bool("keep", false, "keep the allocated ports after the command exits")
+	if err := flags.Parse(args); err != nil {
+		return usage, err
+	}
+
+	if len(ports) == 0 || flags.NArg() == 0 {
+		return usage, errors.New("Both ports and a command are required")
+	}
+
+	c := newClient("exec")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	var allocated []uint16
+
+	release := func() {
+		if *keep {
+			return
+		}
+		for _, port := range allocated {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			if err := c.Release(ctx, port); err != nil {
+				slog.Error("Failed to release the port", "port", port, "err", err)
+			}
+			cancel()
+		}
+	}
+	defer release()
+
+	env := os.Environ()
+
+	for _, pf := range ports {
+
+		port, fresh, err := c.EnsureAllocated(ctx, pf.name)
+		if err != nil {
+			return "Failed to allocate a port for " + pf.name, exitCode(err)
+		}
+		if fresh {
+			allocated = append(allocated, port)
+		}
+
+		env = append(env, pf.env+"="+strconv.Itoa(int(port)))
+	}
+
+	cmd := exec.Command(flags.Arg(0), flags.Args()[1:]...)
+	cmd.Env = env
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	signals := make(chan os.Signal, 4)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGQUIT)
+
+	if err := cmd.Start(); err != nil {
+		signal.Stop(signals)
+		return "Failed to start the command", err
+	}
+
+	forwarded := make(chan struct{})
+	go func() {
+		defer close(forwarded)
+		for sig := range signals {
+			cmd.Process.Signal(sig)
+		}
+	}()
+
+	err := cmd.Wait()
+
+	signal.Stop(signals)
+	close(signals)
+	<-forwarded
+
+	var exited *exec.ExitError
+	if errors.As(err, &exited) {
+		code := exited.ExitCode()
+		if ws, ok := exited.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+			code = 128 + int(ws.Signal())
+		}
+		return "The command failed", &exitError{code, err}
+	}
+
+	return "", err
+}
@@ -0,0 +1,94 @@
+/*
+	(c) Copyright 2015 Vlad Didenko
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	    http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+
+	"github.com/didenko/pald/internal/persist"
+	"github.com/didenko/pald/internal/registry"
+)
+
+// fsck checks the configured storage for invalid records and,
+// if asked to, writes back a repaired state. It refuses to run
+// while the daemon holds the storage.
+func fsck(args []string) (string, error) {
+
+	flags := flag.NewFlagSet("fsck", flag.ContinueOnError)
+	fix := flags.Bool("fix", false, "repair the stored state")
+	if err := flags.Parse(args); err != nil {
+		return "Usage: " + daemonName + " fsck [--fix]", err
+	}
+
+	guard, err := lockStorage()
+	if err != nil {
+		return "Stop the daemon before checking its storage", err
+	}
+	defer guard.Release()
+
+	open := persist.OpenReadOnly
+	if *fix {
+		open = persist.Open
+	}
+
+	store, err := open(storage, storeName())
+	if err != nil {
+		return "Failed to open the registry storage", err
+	}
+	defer store.Close()
+
+	raw := new(rawLoader)
+	if err = store.Load(raw); err != nil {
+		return "Failed to read the registry storage", err
+	}
+
+	reg, problems, err := registry.Fsck(&raw.Buffer, portMin, portMax, *fix)
+	if err != nil {
+		return "Failed to check the registry storage", err
+	}
+
+	for _, p := range problems {
+		fmt.Println(p)
+	}
+
+	if len(problems) == 0 {
+		return fmt.Sprintf("No problems found in %s", storeName()), nil
+	}
+
+	if !*fix {
+		return "", fmt.Errorf("%d problem(s) found in %s", len(problems), storeName())
+	}
+
+	if err = store.Save(reg); err != nil {
+		return "Failed to write the repaired state", err
+	}
+
+	return fmt.Sprintf("%d problem(s) repaired in %s", len(problems), storeName()), nil
+}
+
+// rawLoader keeps the stored state as is
+type rawLoader struct {
+	bytes.Buffer
+}
+
+func (rl *rawLoader) Load(r io.Reader) error {
+	_, err := rl.ReadFrom(r)
+	return err
+}
@@ -0,0 +1,224 @@
+/*
+	(c) Copyright 2015 Vlad Didenko
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	    http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+// Package audit keeps an append-only trail of registry changes
+// in a size-rotated file of JSON lines.
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Events recorded in the trail
+const (
+	Alloc   = "alloc"
+	Release = "release"
+	Import  = "import"
+)
+
+// Entry is a single record of the trail
+type Entry struct {
+	Time    time.Time `json:"time"`
+	Event   string    `json:"event"`
+	Service string    `json:"service"`
+	Port    uint16    `json:"port"`
+	Caller  string    `json:"caller,omitempty"`
+	Client  string    `json:"client,omitempty"`
+}
+
+// Log is a trail file. When it grows over the maximum size it is
+// renamed to name.1, the older name.1 to name.2 and so on, keeping
+// the configured number of rotated files.
+type Log struct {
+	sync.Mutex
+	name    string
+	file    *os.File
+	size    int64
+	maxSize int64
+	keep    int
+}
+
+// Open opens or creates the named trail file for appending
+func Open(name string, maxSize int64, keep int) (*Log, error) {
+
+	l := &Log{name: name, maxSize: maxSize, keep: keep}
+
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+
+	return l, nil
+}
+
+func (l *Log) open() error {
+
+	file, err := os.OpenFile(l.name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	l.file, l.size = file, info.Size()
+	return nil
+}
+
+// Record appends the entry to the trail, stamping it with the
+// current time if it has none. If the trail fails to rotate, the
+// entry is still appended and the rotation is tried again next time.
+func (l *Log) Record(e Entry) error {
+
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	l.Lock()
+	defer l.Unlock()
+
+	var rerr error
+	if l.maxSize > 0 && l.size > 0 && l.size+int64(len(line)) > l.maxSize {
+		rerr = l.rotate()
+	}
+
+	n, err := l.file.Write(line)
+	l.size += int64(n)
+
+	if err == nil {
+		err = rerr
+	}
+	return err
+}
+
+// rotate starts a new trail file. The new file is created before
+// the old ones are renamed, so on failure the current file stays
+// open and in place.
+func (l *Log) rotate() error {
+
+	if l.keep == 0 {
+		if err := l.file.Truncate(0); err != nil {
+			return err
+		}
+		l.size = 0
+		return nil
+	}
+
+	next := l.name + ".new"
+
+	file, err := os.OpenFile(next, os.O_WRONLY|os.O_APPEND|os.O_CREATE|os.O_TRUNC, 0640)
+	if err != nil {
+		return err
+	}
+
+	os.Remove(l.rotated(l.keep))
+	for i := l.keep - 1; i > 0; i-- {
+		os.Rename(l.rotated(i), l.rotated(i+1))
+	}
+
+	if err = os.Rename(l.name, l.rotated(1)); err == nil {
+		err = os.Rename(next, l.name)
+	}
+	if err != nil {
+		file.Close()
+		os.Remove(next)
+		return err
+	}
+
+	l.file.Close()
+	l.file, l.size = file, 0
+
+	return nil
+}
+
+func (l *Log) rotated(i int) string {
+	return fmt.Sprintf("%s.%d", l.name, i)
+}
+
+// Query returns the entries of the service, or of all services if
+// the name is empty, recorded since the given time, oldest first.
+// The files are only opened while holding the trail, so reading
+// them does not delay recording.
+func (l *Log) Query(service string, since time.Time) ([]Entry, error) {
+
+	var readers []io.Reader
+
+	l.Lock()
+	for i := l.keep; i >= 0; i-- {
+
+		name := l.name
+		if i > 0 {
+			name = l.rotated(i)
+		}
+
+		file, err := os.Open(name)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			l.Unlock()
+			return nil, err
+		}
+		defer file.Close()
+
+		if i > 0 {
+			readers = append(readers, file)
+		} else {
+			readers = append(readers, io.LimitReader(file, l.size))
+		}
+	}
+	l.Unlock()
+
+	var entries []Entry
+
+	scanner := bufio.NewScanner(io.MultiReader(readers...))
+	for scanner.Scan() {
+		var e Entry
+		if json.Unmarshal(scanner.Bytes(), &e) != nil {
+			continue
+		}
+		if (service == "" || e.Service == service) && !e.Time.Before(since) {
+			entries = append(entries, e)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
+
+// Close closes the trail file
+func (l *Log) Close() error {
+	l.Lock()
+	defer l.Unlock()
+	return l.file.Close()
+}
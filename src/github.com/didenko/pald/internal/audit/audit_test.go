@@ -0,0 +1,118 @@
+/*
+	(c) Copyright 2015 Vlad Didenko
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	    http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package audit
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestRotateQuery(t *testing.T) {
+	name := "./audit.test"
+	defer os.Remove(name)
+	defer os.Remove(name + ".1")
+	defer os.Remove(name + ".2")
+
+	l, err := Open(name, 200, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	start := time.Date(2015, 6, 1, 0, 0, 0, 0, time.UTC)
+
+	for i := 0; i < 10; i++ {
+		err = l.Record(Entry{
+			Time:    start.Add(time.Duration(i) * time.Minute),
+			Event:   Alloc,
+			Service: []string{"a", "b"}[i%2],
+			Port:    uint16(49201 + i),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err = os.Stat(name + ".3"); !os.IsNotExist(err) {
+		t.Error("Only two rotated files should be kept")
+	}
+
+	all, err := l.Query("", time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) == 0 || len(all) >= 10 {
+		t.Fatalf("The oldest entries should have been rotated away, got %d", len(all))
+	}
+	for i := 1; i < len(all); i++ {
+		if !all[i-1].Time.Before(all[i].Time) {
+			t.Errorf("Entries are out of order: %v", all)
+		}
+	}
+	if all[len(all)-1].Port != 49210 {
+		t.Errorf("The last entry is %v", all[len(all)-1])
+	}
+
+	some, err := l.Query("b", start.Add(7*time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(some) != 2 || some[0].Port != 49208 || some[1].Port != 49210 {
+		t.Errorf("Unexpected query result %v", some)
+	}
+}
+
+func TestRotateFailure(t *testing.T) {
+	name := "./audit_fail.test"
+	defer os.Remove(name)
+	defer os.Remove(name + ".1")
+
+	l, err := Open(name, 100, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// A directory in the way of the new file fails the rotation
+	if err = os.Mkdir(name+".new", 0750); err != nil {
+		t.Fatal(err)
+	}
+
+	entry := Entry{Event: Alloc, Service: "a", Port: 49201}
+
+	if err = l.Record(entry); err != nil {
+		t.Fatal(err)
+	}
+	if err = l.Record(entry); err == nil {
+		t.Error("A failed rotation should be reported")
+	}
+
+	os.Remove(name + ".new")
+
+	if err = l.Record(entry); err != nil {
+		t.Fatalf("Recording after a failed rotation returned %v", err)
+	}
+
+	all, err := l.Query("a", time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 3 {
+		t.Errorf("Expected all 3 entries to be kept, got %d", len(all))
+	}
+}
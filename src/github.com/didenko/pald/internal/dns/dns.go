@@ -0,0 +1,352 @@
+/*
+	(c) Copyright 2015 Vlad Didenko
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	    http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+// Package dns answers DNS queries about the registered services: SRV
+// records with their ports and A and AAAA records with their addresses.
+// It implements just enough of RFC 1035 for an authoritative server
+// of a single zone, over both UDP and TCP.
+package dns
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+)
+
+// Record types and classes in use
+const (
+	typeA    = 1
+	typeNS   = 2
+	typeSOA  = 6
+	typeAAAA = 28
+	typeSRV  = 33
+
+	classIN = 1
+)
+
+// Response codes in use
+const (
+	rcodeOK       = 0
+	rcodeFormErr  = 1
+	rcodeServFail = 2
+	rcodeNXDomain = 3
+	rcodeNotImp   = 4
+	rcodeRefused  = 5
+)
+
+// maxUDP is the size of a UDP response without EDNS
+const maxUDP = 512
+
+var errFormat = errors.New("Malformed DNS message")
+
+// Lookup returns the port and the addresses of the service, ok false
+// if it is not registered, or an error if the registry is unavailable
+type Lookup func(name string) (port uint16, addr []string, ok bool, err error)
+
+// Responder answers the queries about the services in the zone.
+// A service "web" has the SRV record _web._tcp.<zone> (or _udp)
+// pointing at web.<zone>, which has the A and AAAA records of
+// its addresses, or of the loopback if it has none.
+type Responder struct {
+	mu     sync.RWMutex
+	zone   string
+	ttl    uint32
+	lookup Lookup
+}
+
+// New returns a responder for the zone, like "pald", answering
+// with the TTL in seconds
+func New(zone string, ttl uint32, lookup Lookup) *Responder {
+	rs := &Responder{lookup: lookup}
+	rs.Configure(zone, ttl)
+	return rs
+}
+
+// Configure changes the zone and the TTL
+func (rs *Responder) Configure(zone string, ttl uint32) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	rs.zone = strings.ToLower(strings.Trim(zone, ".")) + "."
+	rs.ttl = ttl
+}
+
+// question is the single question of a query
+type question struct {
+	name  string
+	qtype uint16
+	class uint16
+	end   int
+}
+
+// Answer returns the response to the query, no longer than the limit
+// if it is not zero, or nil if the query should be dropped
+func (rs *Responder) Answer(query []byte, limit int) []byte {
+
+	if len(query) < 12 || query[2]&0x80 != 0 {
+		// Too short to reply to, or a response
+		return nil
+	}
+
+	b := &builder{msg: append([]byte(nil), query[:12]...)}
+
+	// QR and AA set, the opcode and RD kept, the rest cleared
+	b.msg[2] = 0x80 | query[2]&0x79 | 0x04
+	b.msg[3] = 0
+	for i := 4; i < 12; i++ {
+		b.msg[i] = 0
+	}
+
+	if opcode := query[2] >> 3 & 0x0f; opcode != 0 {
+		return b.fail(rcodeNotImp)
+	}
+
+	if binary.BigEndian.Uint16(query[4:6]) != 1 {
+		return b.fail(rcodeFormErr)
+	}
+
+	q, err := parseQuestion(query)
+	if err != nil {
+		return b.fail(rcodeFormErr)
+	}
+
+	b.msg = append(b.msg, query[12:q.end]...)
+	binary.BigEndian.PutUint16(b.msg[4:6], 1)
+
+	if q.class != classIN {
+		return b.fail(rcodeRefused)
+	}
+
+	rs.mu.RLock()
+	rs.resolve(b, q)
+	rs.mu.RUnlock()
+
+	if limit > 0 && len(b.msg) > limit {
+		// Truncated to the question, the client retries over TCP
+		b.msg = b.msg[:q.end]
+		b.msg[2] |= 0x02
+		for i := 6; i < 12; i++ {
+			b.msg[i] = 0
+		}
+	}
+
+	return b.msg
+}
+
+// resolve adds the records answering the question
+func (rs *Responder) resolve(b *builder, q question) {
+
+	name := strings.ToLower(q.name)
+
+	if name == rs.zone {
+		if q.qtype == typeSOA {
+			b.soa(sectionAnswer, rs)
+		} else {
+			b.soa(sectionAuthority, rs)
+		}
+		return
+	}
+
+	if !strings.HasSuffix(name, "."+rs.zone) {
+		b.fail(rcodeRefused)
+		return
+	}
+	host := q.name[:len(q.name)-len(rs.zone)-1]
+
+	service, srv := srvService(host)
+
+	port, addr, found, err := rs.lookup(service)
+	if err != nil {
+		b.fail(rcodeServFail)
+		return
+	}
+	if !found {
+		b.msg[3] = rcodeNXDomain
+		b.soa(sectionAuthority, rs)
+		return
+	}
+
+	target := service + "." + rs.zone
+
+	switch {
+	case srv && q.qtype == typeSRV:
+		b.srv(q.name, rs.ttl, port, target)
+		b.addrs(sectionAdditional, target, rs.ttl, addr, typeA)
+		b.addrs(sectionAdditional, target, rs.ttl, addr, typeAAAA)
+	case !srv && (q.qtype == typeA || q.qtype == typeAAAA):
+		b.addrs(sectionAnswer, q.name, rs.ttl, addr, q.qtype)
+	}
+
+	if b.count(sectionAnswer) == 0 {
+		b.soa(sectionAuthority, rs)
+	}
+}
+
+// srvService tells the service name from the host part of
+// the query name, either _service._tcp, _service._udp or service
+func srvService(host string) (string, bool) {
+
+	if !strings.HasPrefix(host, "_") {
+		return host, false
+	}
+
+	for _, proto := range []string{"._tcp", "._udp"} {
+		if len(host) > len(proto)+1 && strings.EqualFold(host[len(host)-len(proto):], proto) {
+			return host[1 : len(host)-len(proto)], true
+		}
+	}
+
+	return host, false
+}
+
+// parseQuestion reads the question following the header
+func parseQuestion(msg []byte) (question, error) {
+
+	var (
+		q      question
+		labels []string
+		i      = 12
+	)
+
+	for {
+		if i >= len(msg) {
+			return q, errFormat
+		}
+
+		size := int(msg[i])
+		i++
+
+		if size == 0 {
+			break
+		}
+		if size > 63 || i+size > len(msg) {
+			// Compression pointers are not expected in questions
+			return q, errFormat
+		}
+
+		labels = append(labels, string(msg[i:i+size]))
+		i += size
+	}
+
+	if i+4 > len(msg) {
+		return q, errFormat
+	}
+
+	q.name = strings.Join(labels, ".") + "."
+	q.qtype = binary.BigEndian.Uint16(msg[i:])
+	q.class = binary.BigEndian.Uint16(msg[i+2:])
+	q.end = i + 4
+
+	return q, nil
+}
+
+// Message sections by the index of their counts in the header
+const (
+	sectionAnswer     = 6
+	sectionAuthority  = 8
+	sectionAdditional = 10
+)
+
+// builder appends the records to the response in the order of
+// the sections: answers first, then authority, then additional
+type builder struct {
+	msg []byte
+}
+
+func (b *builder) fail(rcode byte) []byte {
+	b.msg[3] = rcode
+	return b.msg
+}
+
+func (b *builder) count(section int) uint16 {
+	return binary.BigEndian.Uint16(b.msg[section:])
+}
+
+// record appends the record header and the data
+func (b *builder) record(section int, name string, rtype uint16, ttl uint32, data []byte) {
+
+	b.msg = appendName(b.msg, name)
+	b.msg = binary.BigEndian.AppendUint16(b.msg, rtype)
+	b.msg = binary.BigEndian.AppendUint16(b.msg, classIN)
+	b.msg = binary.BigEndian.AppendUint32(b.msg, ttl)
+	b.msg = binary.BigEndian.AppendUint16(b.msg, uint16(len(data)))
+	b.msg = append(b.msg, data...)
+
+	binary.BigEndian.PutUint16(b.msg[section:], b.count(section)+1)
+}
+
+func (b *builder) srv(name string, ttl uint32, port uint16, target string) {
+	data := make([]byte, 6, 6+len(target)+2)
+	binary.BigEndian.PutUint16(data[4:], port)
+	b.record(sectionAnswer, name, typeSRV, ttl, appendName(data, target))
+}
+
+// addrs appends the addresses of the type, or the loopback if none
+// is given. The addresses which are not IPs are skipped.
+func (b *builder) addrs(section int, name string, ttl uint32, addr []string, rtype uint16) {
+
+	if len(addr) == 0 {
+		addr = []string{"127.0.0.1", "::1"}
+	}
+
+	for _, a := range addr {
+
+		if host, _, err := net.SplitHostPort(a); err == nil {
+			a = host
+		}
+
+		ip := net.ParseIP(a)
+		switch {
+		case ip == nil:
+		case rtype == typeA && ip.To4() != nil:
+			b.record(section, name, typeA, ttl, ip.To4())
+		case rtype == typeAAAA && ip.To4() == nil:
+			b.record(section, name, typeAAAA, ttl, ip.To16())
+		}
+	}
+}
+
+// soa appends the start of authority of the zone, which
+// also tells the resolvers how long to cache the negative
+// answers
+func (b *builder) soa(section int, rs *Responder) {
+
+	data := appendName(nil, rs.zone)
+	data = appendName(data, "hostmaster."+rs.zone)
+	for _, v := range []uint32{1, 3600, 600, 86400, rs.ttl} {
+		data = binary.BigEndian.AppendUint32(data, v)
+	}
+
+	b.record(section, rs.zone, typeSOA, rs.ttl, data)
+}
+
+// appendName appends the name in the wire format, without compression
+func appendName(msg []byte, name string) []byte {
+
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if label == "" {
+			continue
+		}
+		if len(label) > 63 {
+			label = label[:63]
+		}
+		msg = append(msg, byte(len(label)))
+		msg = append(msg, label...)
+	}
+
+	return append(msg, 0)
+}
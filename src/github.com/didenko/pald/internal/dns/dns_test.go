@@ -0,0 +1,225 @@
+/*
+	(c) Copyright 2015 Vlad Didenko
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	    http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package dns
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+)
+
+var services = map[string]struct {
+	port uint16
+	addr []string
+}{
+	"web": {49201, nil},
+	"db":  {49202, []string{"10.0.0.5", "fd00::5", "db.example.com", "10.0.0.6:5432"}},
+}
+
+func testLookup(name string) (uint16, []string, bool, error) {
+	if name == "broken" {
+		return 0, nil, false, errors.New("Not loaded")
+	}
+	svc, ok := services[name]
+	return svc.port, svc.addr, ok, nil
+}
+
+func query(name string, qtype uint16) []byte {
+	msg := []byte{0xbe, 0xef, 0x01, 0x00, 0, 1, 0, 0, 0, 0, 0, 0}
+	msg = appendName(msg, name)
+	msg = binary.BigEndian.AppendUint16(msg, qtype)
+	return binary.BigEndian.AppendUint16(msg, classIN)
+}
+
+// rr is a decoded resource record
+type rr struct {
+	name  string
+	rtype uint16
+	ttl   uint32
+	data  []byte
+}
+
+// parse returns the rcode and the records of the sections
+func parse(t *testing.T, msg []byte) (int, [3][]rr) {
+
+	var sections [3][]rr
+
+	q, err := parseQuestion(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	i := q.end
+	for s := 0; s < 3; s++ {
+		for n := binary.BigEndian.Uint16(msg[6+2*s:]); n > 0; n-- {
+			var labels []byte
+			for msg[i] != 0 {
+				labels = append(labels, msg[i+1:i+1+int(msg[i])]...)
+				labels = append(labels, '.')
+				i += 1 + int(msg[i])
+			}
+			i++
+			r := rr{name: string(labels)}
+			r.rtype = binary.BigEndian.Uint16(msg[i:])
+			r.ttl = binary.BigEndian.Uint32(msg[i+4:])
+			size := int(binary.BigEndian.Uint16(msg[i+8:]))
+			r.data = msg[i+10 : i+10+size]
+			i += 10 + size
+			sections[s] = append(sections[s], r)
+		}
+	}
+
+	if i != len(msg) {
+		t.Errorf("%d bytes left after the records", len(msg)-i)
+	}
+
+	return int(msg[3] & 0x0f), sections
+}
+
+func TestAnswer(t *testing.T) {
+
+	rs := New("pald.", 5, testLookup)
+
+	for _, tc := range []struct {
+		name   string
+		qtype  uint16
+		rcode  int
+		answer []uint16
+		extra  []uint16
+	}{
+		{"_web._tcp.pald.", typeSRV, rcodeOK, []uint16{typeSRV}, []uint16{typeA, typeAAAA}},
+		{"_db._UDP.PALD.", typeSRV, rcodeOK, []uint16{typeSRV}, []uint16{typeA, typeA, typeAAAA}},
+		{"db.pald.", typeA, rcodeOK, []uint16{typeA, typeA}, nil},
+		{"db.pald.", typeAAAA, rcodeOK, []uint16{typeAAAA}, nil},
+		{"web.pald.", typeA, rcodeOK, []uint16{typeA}, nil},
+		{"web.pald.", typeSRV, rcodeOK, nil, nil},
+		{"_web._tcp.pald.", typeA, rcodeOK, nil, nil},
+		{"pald.", typeSOA, rcodeOK, []uint16{typeSOA}, nil},
+		{"pald.", typeNS, rcodeOK, nil, nil},
+		{"_mail._tcp.pald.", typeSRV, rcodeNXDomain, nil, nil},
+		{"broken.pald.", typeA, rcodeServFail, nil, nil},
+		{"example.com.", typeA, rcodeRefused, nil, nil},
+	} {
+		rcode, sections := parse(t, rs.Answer(query(tc.name, tc.qtype), maxUDP))
+
+		if rcode != tc.rcode {
+			t.Errorf("Query %s %d returned rcode %d instead of %d", tc.name, tc.qtype, rcode, tc.rcode)
+			continue
+		}
+
+		types := func(records []rr) []uint16 {
+			var tt []uint16
+			for _, r := range records {
+				tt = append(tt, r.rtype)
+			}
+			return tt
+		}
+
+		if got := types(sections[0]); !equal(got, tc.answer) {
+			t.Errorf("Query %s %d answered %v instead of %v", tc.name, tc.qtype, got, tc.answer)
+		}
+		if got := types(sections[2]); !equal(got, tc.extra) {
+			t.Errorf("Query %s %d added %v instead of %v", tc.name, tc.qtype, got, tc.extra)
+		}
+
+		negative := rcode == rcodeNXDomain || rcode == rcodeOK && len(tc.answer) == 0
+		if negative && (len(sections[1]) != 1 || sections[1][0].rtype != typeSOA) {
+			t.Errorf("Negative answer to %s %d lacks the SOA", tc.name, tc.qtype)
+		}
+	}
+
+	_, sections := parse(t, rs.Answer(query("_db._tcp.pald.", typeSRV), 0))
+	srv := sections[0][0]
+	if srv.name != "_db._tcp.pald." || srv.ttl != 5 || binary.BigEndian.Uint16(srv.data[4:]) != 49202 ||
+		string(srv.data[6:]) != "\x02db\x04pald\x00" {
+		t.Errorf("Unexpected SRV record %+v", srv)
+	}
+
+	if ip := net.IP(sections[2][1].data); !ip.Equal(net.ParseIP("10.0.0.6")) {
+		t.Errorf("Address with a port answered as %v", ip)
+	}
+
+	if resp := rs.Answer(query("_db._tcp.pald.", typeSRV), 60); resp[2]&0x02 == 0 || resp[7] != 0 {
+		t.Error("An oversized response should be truncated")
+	}
+
+	if resp := rs.Answer([]byte{1, 2, 3}, maxUDP); resp != nil {
+		t.Error("A short message should be dropped")
+	}
+}
+
+func equal(a, b []uint16) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestListen(t *testing.T) {
+
+	srv, err := Listen("127.0.0.1:0", New("pald", 5, testLookup))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	udp, err := net.Dial("udp", srv.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udp.Close()
+
+	udp.Write(query("web.pald.", typeA))
+	buf := make([]byte, maxUDP)
+	n, err := udp.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, sections := parse(t, buf[:n]); len(sections[0]) != 1 {
+		t.Errorf("UDP query answered %v", sections[0])
+	}
+
+	tcp, err := net.Dial("tcp", srv.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcp.Close()
+
+	for i := 0; i < 2; i++ {
+		q := query("db.pald.", typeA)
+		tcp.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(q))), q...))
+
+		var size [2]byte
+		if _, err = io.ReadFull(tcp, size[:]); err != nil {
+			t.Fatal(err)
+		}
+		resp := make([]byte, binary.BigEndian.Uint16(size[:]))
+		if _, err = io.ReadFull(tcp, resp); err != nil {
+			t.Fatal(err)
+		}
+		if _, sections := parse(t, resp); len(sections[0]) != 2 {
+			t.Errorf("TCP query %d answered %v", i, sections[0])
+		}
+	}
+}
@@ -0,0 +1,164 @@
+/*
+	(c) Copyright 2015 Vlad Didenko
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	    http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package dns
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// tcpTimeout limits waiting for a query on a TCP connection
+const tcpTimeout = 10 * time.Second
+
+// Server serves a Responder over UDP and TCP at the same address
+type Server struct {
+	udp net.PacketConn
+	tcp net.Listener
+	wg  sync.WaitGroup
+
+	mu    sync.Mutex
+	conns map[net.Conn]struct{}
+}
+
+// Listen starts serving the responder at the address,
+// like 127.0.0.1:5353
+func Listen(addr string, rs *Responder) (*Server, error) {
+
+	udp, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	// The same port for TCP, in case the UDP one was picked
+	tcp, err := net.Listen("tcp", udp.LocalAddr().String())
+	if err != nil {
+		udp.Close()
+		return nil, err
+	}
+
+	srv := &Server{udp: udp, tcp: tcp, conns: make(map[net.Conn]struct{})}
+
+	srv.wg.Add(2)
+	go srv.serveUDP(rs)
+	go srv.serveTCP(rs)
+
+	return srv, nil
+}
+
+// Addr returns the address served
+func (srv *Server) Addr() net.Addr {
+	return srv.udp.LocalAddr()
+}
+
+// Close stops serving and waits for the queries in progress
+func (srv *Server) Close() error {
+	err := srv.udp.Close()
+	if terr := srv.tcp.Close(); err == nil {
+		err = terr
+	}
+
+	srv.mu.Lock()
+	for conn := range srv.conns {
+		conn.Close()
+	}
+	srv.mu.Unlock()
+
+	srv.wg.Wait()
+	return err
+}
+
+func (srv *Server) serveUDP(rs *Responder) {
+
+	defer srv.wg.Done()
+
+	buf := make([]byte, 65535)
+
+	for {
+		n, peer, err := srv.udp.ReadFrom(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				continue
+			}
+			return
+		}
+
+		if resp := rs.Answer(buf[:n], maxUDP); resp != nil {
+			srv.udp.WriteTo(resp, peer)
+		}
+	}
+}
+
+func (srv *Server) serveTCP(rs *Responder) {
+
+	defer srv.wg.Done()
+
+	var conns sync.WaitGroup
+	defer conns.Wait()
+
+	for {
+		conn, err := srv.tcp.Accept()
+		if err != nil {
+			return
+		}
+
+		srv.mu.Lock()
+		srv.conns[conn] = struct{}{}
+		srv.mu.Unlock()
+
+		conns.Add(1)
+		go func() {
+			defer conns.Done()
+			serveConn(conn, rs)
+			conn.Close()
+
+			srv.mu.Lock()
+			delete(srv.conns, conn)
+			srv.mu.Unlock()
+		}()
+	}
+}
+
+// serveConn answers the length prefixed queries on the connection
+func serveConn(conn net.Conn, rs *Responder) {
+
+	for {
+		conn.SetDeadline(time.Now().Add(tcpTimeout))
+
+		var size [2]byte
+		if _, err := io.ReadFull(conn, size[:]); err != nil {
+			return
+		}
+
+		query := make([]byte, binary.BigEndian.Uint16(size[:]))
+		if _, err := io.ReadFull(conn, query); err != nil {
+			return
+		}
+
+		resp := rs.Answer(query, 65535)
+		if resp == nil {
+			return
+		}
+
+		frame := binary.BigEndian.AppendUint16(nil, uint16(len(resp)))
+		if _, err := conn.Write(append(frame, resp...)); err != nil {
+			return
+		}
+	}
+}
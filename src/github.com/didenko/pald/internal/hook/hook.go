@@ -0,0 +1,203 @@
+/*
+	(c) Copyright 2015 Vlad Didenko
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	    http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+// Package hook runs local commands before and after
+// services are allocated and released.
+package hook
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/didenko/pald/internal/registry"
+)
+
+// Commands are the hooks, each a program and its arguments, run
+// without a shell. Empty commands are not run.
+type Commands struct {
+	PreAlloc    []string
+	PostAlloc   []string
+	PreRelease  []string
+	PostRelease []string
+
+	// Timeout limits every run, 10 seconds by default
+	Timeout time.Duration
+}
+
+// postQueue is how many events wait for the post hooks
+// before new ones are dropped
+const postQueue = 100
+
+// Error is a failed hook run with the beginning of its output
+type Error struct {
+	Command string
+	Err     error
+	Output  string
+}
+
+func (e *Error) Error() string {
+	msg := fmt.Sprintf("Hook %q failed: %s", e.Command, e.Err)
+	if e.Output != "" {
+		msg += ": " + e.Output
+	}
+	return msg
+}
+
+// Runner runs the pre hooks on request, and the post hooks
+// one by one in the background in the order of the events
+type Runner struct {
+	cmds   Commands
+	queue  chan registry.Event
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// New returns a runner of the commands
+func New(cmds Commands) *Runner {
+
+	if cmds.Timeout <= 0 {
+		cmds.Timeout = 10 * time.Second
+	}
+
+	r := &Runner{cmds: cmds, queue: make(chan registry.Event, postQueue)}
+	r.ctx, r.cancel = context.WithCancel(context.Background())
+
+	r.wg.Add(1)
+	go r.post()
+
+	return r
+}
+
+// Close stops the runner, killing running hooks and
+// dropping the queued post hooks
+func (r *Runner) Close() {
+	r.cancel()
+	r.wg.Wait()
+}
+
+// HasPre tells if there is a pre hook for the kind of events
+func (r *Runner) HasPre(kind registry.EventKind) bool {
+	if kind == registry.EventRelease {
+		return len(r.cmds.PreRelease) > 0
+	}
+	return len(r.cmds.PreAlloc) > 0
+}
+
+// Pre runs the pre hook of the event, if any, and returns an *Error
+// if it fails, meaning the hook vetoes the change
+func (r *Runner) Pre(ev registry.Event) error {
+
+	cmd := r.cmds.PreAlloc
+	if ev.Kind == registry.EventRelease {
+		cmd = r.cmds.PreRelease
+	}
+
+	return r.run(cmd, "pre", ev)
+}
+
+// Post queues the post hook of the event. It never blocks:
+// if the queue is full the event is dropped. Post fits
+// registry.Notify.
+func (r *Runner) Post(ev registry.Event) {
+
+	if ev.Kind == registry.EventWatermark ||
+		len(r.cmds.PostAlloc) == 0 && len(r.cmds.PostRelease) == 0 {
+		return
+	}
+
+	select {
+	case r.queue <- ev:
+	default:
+		slog.Warn("Post hook queue is full, event dropped", "event", ev.Kind, "service", ev.Name)
+	}
+}
+
+func (r *Runner) post() {
+
+	defer r.wg.Done()
+
+	for {
+		select {
+		case <-r.ctx.Done():
+			return
+		case ev := <-r.queue:
+			var cmd []string
+			switch ev.Kind {
+			case registry.EventAlloc:
+				cmd = r.cmds.PostAlloc
+			case registry.EventRelease:
+				cmd = r.cmds.PostRelease
+			}
+			if err := r.run(cmd, "post", ev); err != nil {
+				slog.Warn("Post hook failed", "event", ev.Kind, "service", ev.Name, "err", err)
+			}
+		}
+	}
+}
+
+// run executes the command with the event in the environment
+func (r *Runner) run(argv []string, stage string, ev registry.Event) error {
+
+	if len(argv) == 0 {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(r.ctx, r.cmds.Timeout)
+	defer cancel()
+
+	var out bytes.Buffer
+
+	cmd := exec.CommandContext(ctx, argv[0], argv[1:]...)
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	cmd.WaitDelay = time.Second
+	cmd.Env = append(os.Environ(),
+		"PALD_STAGE="+stage,
+		"PALD_EVENT="+string(ev.Kind),
+		"PALD_SERVICE="+ev.Name,
+		"PALD_PORT="+strconv.Itoa(int(ev.Port)),
+		"PALD_ADDR="+strings.Join(ev.Addr, ","))
+
+	start := time.Now()
+	err := cmd.Run()
+
+	slog.Debug("Hook run", "stage", stage, "event", ev.Kind, "service", ev.Name,
+		"command", argv[0], "duration", time.Since(start), "err", err)
+
+	if err == nil {
+		return nil
+	}
+
+	if ctx.Err() == context.DeadlineExceeded {
+		err = fmt.Errorf("timed out after %s", r.cmds.Timeout)
+	}
+
+	output := strings.TrimSpace(out.String())
+	if len(output) > 200 {
+		output = output[:200] + "..."
+	}
+
+	return &Error{Command: argv[0], Err: err, Output: output}
+}
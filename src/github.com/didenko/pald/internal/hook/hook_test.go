@@ -0,0 +1,107 @@
+/*
+	(c) Copyright 2015 Vlad Didenko
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	    http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package hook
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/didenko/pald/internal/registry"
+)
+
+var alloc = registry.Event{
+	Kind:  registry.EventAlloc,
+	Entry: registry.Entry{Name: "web", Port: 49201, Addr: []string{"127.0.0.1", "::1"}},
+}
+
+func TestPre(t *testing.T) {
+
+	out := "./hook_env.test"
+	defer os.Remove(out)
+
+	r := New(Commands{
+		PreAlloc:   []string{"sh", "-c", `echo "$PALD_STAGE $PALD_EVENT $PALD_SERVICE $PALD_PORT $PALD_ADDR" > ` + out},
+		PreRelease: []string{"sh", "-c", "echo no way; exit 3"},
+	})
+	defer r.Close()
+
+	if err := r.Pre(alloc); err != nil {
+		t.Fatal(err)
+	}
+
+	env, _ := ioutil.ReadFile(out)
+	if string(env) != "pre alloc web 49201 127.0.0.1,::1\n" {
+		t.Errorf("The hook got the environment %q", env)
+	}
+
+	release := alloc
+	release.Kind = registry.EventRelease
+
+	err := r.Pre(release)
+	if he, ok := err.(*Error); !ok || he.Output != "no way" || !strings.Contains(he.Error(), "exit status 3") {
+		t.Errorf("A failing hook returned %v", err)
+	}
+}
+
+func TestTimeout(t *testing.T) {
+
+	r := New(Commands{PreAlloc: []string{"sleep", "10"}, Timeout: 100 * time.Millisecond})
+	defer r.Close()
+
+	start := time.Now()
+	err := r.Pre(alloc)
+
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Errorf("A slow hook returned %v", err)
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Error("The timeout is not enforced")
+	}
+}
+
+func TestPost(t *testing.T) {
+
+	out := "./hook_post.test"
+	defer os.Remove(out)
+
+	r := New(Commands{
+		PostAlloc:   []string{"sh", "-c", `echo "$PALD_EVENT $PALD_PORT" >> ` + out},
+		PostRelease: []string{"sh", "-c", `echo "$PALD_EVENT $PALD_PORT" >> ` + out},
+	})
+	defer r.Close()
+
+	release := alloc
+	release.Kind = registry.EventRelease
+
+	r.Post(alloc)
+	r.Post(release)
+
+	expected := "alloc 49201\nrelease 49201\n"
+
+	for i := 0; i < 100; i++ {
+		if got, _ := ioutil.ReadFile(out); string(got) == expected {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	got, _ := ioutil.ReadFile(out)
+	t.Errorf("Post hooks wrote %q instead of %q", got, expected)
+}
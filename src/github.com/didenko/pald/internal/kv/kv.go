@@ -0,0 +1,532 @@
+/*
+	(c) Copyright 2015 Vlad Didenko
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	    http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+// Package kv is a minimal embedded single-file key-value store.
+//
+// The file is an append-only journal of transactions. Every committed
+// transaction is a single checksummed frame followed by fsync, so a
+// crash can only lose a trailing partial frame, which is discarded
+// with a warning on the next Open. Any other corrupt frame fails the
+// Open, as the transactions after it would be lost.
+// The journal is compacted on Open when it grows much larger than
+// the live data.
+package kv
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+const (
+	magic = "PALDKV1\n"
+
+	opPut byte = 'P'
+	opDel byte = 'D'
+
+	compactMin = 64 * 1024
+)
+
+var (
+	ErrClosed   = errors.New("The key-value store is closed")
+	ErrReadOnly = errors.New("The key-value store is open read-only")
+)
+
+type DB struct {
+	sync.RWMutex
+	file *os.File
+	name string
+	data map[string][]byte
+	size int64
+	live int64
+
+	readOnly bool
+}
+
+type Tx struct {
+	db       *DB
+	writable bool
+	ops      []op
+}
+
+type op struct {
+	code  byte
+	key   string
+	value []byte
+}
+
+// Open opens or creates the store in the named file
+func Open(name string) (*DB, error) {
+
+	file, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0660)
+	if err != nil {
+		return nil, err
+	}
+
+	db := &DB{
+		file: file,
+		name: name,
+		data: make(map[string][]byte, 100),
+	}
+
+	if err = db.replay(); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	if db.size > compactMin && db.size > 2*db.live {
+		if err = db.compact(); err != nil {
+			db.file.Close()
+			return nil, err
+		}
+	}
+
+	return db, nil
+}
+
+// OpenReadOnly opens an existing store without changing the file. A
+// torn tail is skipped rather than cut off, and updates are refused.
+func OpenReadOnly(name string) (*DB, error) {
+
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+
+	db := &DB{
+		file:     file,
+		name:     name,
+		data:     make(map[string][]byte, 100),
+		readOnly: true,
+	}
+
+	if err = db.replay(); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return db, nil
+}
+
+// Close releases the underlying file
+func (db *DB) Close() error {
+
+	db.Lock()
+	defer db.Unlock()
+
+	if db.file == nil {
+		return ErrClosed
+	}
+
+	err := db.file.Close()
+	db.file = nil
+	return err
+}
+
+// View runs fn in a read-only transaction
+func (db *DB) View(fn func(*Tx) error) error {
+
+	db.RLock()
+	defer db.RUnlock()
+
+	if db.file == nil {
+		return ErrClosed
+	}
+
+	return fn(&Tx{db: db})
+}
+
+// Update runs fn in a read-write transaction. The changes are
+// written to the disk only if fn returns no error, and either
+// all or none of them survive a crash.
+func (db *DB) Update(fn func(*Tx) error) error {
+
+	db.Lock()
+	defer db.Unlock()
+
+	if db.file == nil {
+		return ErrClosed
+	}
+
+	if db.readOnly {
+		return ErrReadOnly
+	}
+
+	tx := &Tx{db: db, writable: true}
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+
+	if len(tx.ops) == 0 {
+		return nil
+	}
+
+	frame := encode(tx.ops)
+
+	if _, err := db.file.Seek(db.size, 0); err != nil {
+		return err
+	}
+
+	if _, err := db.file.Write(frame); err != nil {
+		db.file.Truncate(db.size)
+		return err
+	}
+
+	if err := db.file.Sync(); err != nil {
+		return err
+	}
+
+	db.size += int64(len(frame))
+	db.apply(tx.ops)
+
+	return nil
+}
+
+// Get returns the value stored under the key, or nil if none
+func (tx *Tx) Get(key []byte) []byte {
+	for i := len(tx.ops) - 1; i >= 0; i-- {
+		if tx.ops[i].key == string(key) {
+			return tx.ops[i].value
+		}
+	}
+	return tx.db.data[string(key)]
+}
+
+// Put stores the value under the key
+func (tx *Tx) Put(key, value []byte) error {
+	if !tx.writable {
+		return errors.New("Put is not allowed in a read-only transaction")
+	}
+	if value == nil {
+		value = []byte{}
+	}
+	tx.ops = append(tx.ops, op{opPut, string(key), append([]byte(nil), value...)})
+	return nil
+}
+
+// Delete removes the key. A missing key is not an error.
+func (tx *Tx) Delete(key []byte) error {
+	if !tx.writable {
+		return errors.New("Delete is not allowed in a read-only transaction")
+	}
+	tx.ops = append(tx.ops, op{opDel, string(key), nil})
+	return nil
+}
+
+// ForEach calls fn for every key in the ascending order of keys,
+// as they were at the start of the transaction
+func (tx *Tx) ForEach(fn func(key, value []byte) error) error {
+
+	keys := make([]string, 0, len(tx.db.data))
+	for k := range tx.db.data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		if err := fn([]byte(k), tx.db.data[k]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (db *DB) apply(ops []op) {
+	for _, o := range ops {
+		if old, ok := db.data[o.key]; ok {
+			db.live -= recordSize(o.key, old)
+			delete(db.data, o.key)
+		}
+		if o.code == opPut {
+			db.data[o.key] = o.value
+			db.live += recordSize(o.key, o.value)
+		}
+	}
+}
+
+// replay reads all complete frames and cuts off a torn tail,
+// but fails on any other corrupt frame
+func (db *DB) replay() error {
+
+	info, err := db.file.Stat()
+	if err != nil {
+		return err
+	}
+
+	if info.Size() == 0 {
+		db.size = int64(len(magic))
+		if db.readOnly {
+			return nil
+		}
+		if _, err = db.file.Write([]byte(magic)); err != nil {
+			return err
+		}
+		return db.file.Sync()
+	}
+
+	rd := bufio.NewReader(db.file)
+
+	head := make([]byte, len(magic))
+	if _, err = io.ReadFull(rd, head); err != nil || string(head) != magic {
+		return fmt.Errorf("File %q is not a key-value store", db.name)
+	}
+	db.size = int64(len(magic))
+
+	for {
+		ops, n, err := decode(rd, info.Size()-db.size)
+
+		if err == io.EOF {
+			break
+		}
+
+		if err == io.ErrUnexpectedEOF {
+			slog.Warn("Discarding a partially written transaction", "file", db.name, "offset", db.size, "bytes", info.Size()-db.size)
+			break
+		}
+
+		if err != nil {
+			if n > 0 && db.size+n == info.Size() {
+				slog.Warn("Discarding a corrupt last transaction", "file", db.name, "offset", db.size, "bytes", n, "err", err)
+				break
+			}
+			return fmt.Errorf("File %q has a corrupt transaction at offset %d: %s", db.name, db.size, err)
+		}
+
+		db.apply(ops)
+		db.size += n
+	}
+
+	if db.size < info.Size() && !db.readOnly {
+		return db.file.Truncate(db.size)
+	}
+
+	return nil
+}
+
+func (db *DB) compact() error {
+
+	ops := make([]op, 0, len(db.data))
+	for k, v := range db.data {
+		ops = append(ops, op{opPut, k, v})
+	}
+
+	tmpName := db.name + ".compact"
+
+	tmp, err := os.OpenFile(tmpName, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0660)
+	if err != nil {
+		return err
+	}
+
+	frame := encode(ops)
+
+	_, err = tmp.Write(append([]byte(magic), frame...))
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmpName, db.name)
+	}
+	if err == nil {
+		err = syncDir(filepath.Dir(db.name))
+	}
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmpName)
+		return err
+	}
+
+	db.file.Close()
+	db.file = tmp
+	db.size = int64(len(magic) + len(frame))
+
+	return nil
+}
+
+// syncDir makes a rename in the directory durable
+func syncDir(name string) error {
+
+	dir, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+
+	return dir.Sync()
+}
+
+func recordSize(key string, value []byte) int64 {
+	return int64(1 + 2*binary.MaxVarintLen32 + len(key) + len(value))
+}
+
+// A frame is: payload length (uint32), payload CRC32 (uint32), payload.
+// The payload is a sequence of operations: code, key length (uvarint),
+// key, and for puts the value length (uvarint) and value.
+func encode(ops []op) []byte {
+
+	var (
+		payload bytes.Buffer
+		lenBuf  [binary.MaxVarintLen64]byte
+	)
+
+	for _, o := range ops {
+		payload.WriteByte(o.code)
+		payload.Write(lenBuf[:binary.PutUvarint(lenBuf[:], uint64(len(o.key)))])
+		payload.WriteString(o.key)
+		if o.code == opPut {
+			payload.Write(lenBuf[:binary.PutUvarint(lenBuf[:], uint64(len(o.value)))])
+			payload.Write(o.value)
+		}
+	}
+
+	frame := make([]byte, 8, 8+payload.Len())
+	binary.BigEndian.PutUint32(frame[0:4], uint32(payload.Len()))
+	binary.BigEndian.PutUint32(frame[4:8], crc32.ChecksumIEEE(payload.Bytes()))
+
+	return append(frame, payload.Bytes()...)
+}
+
+// decode reads a frame from the left bytes of the journal and
+// returns its operations and size. At the end of the journal it
+// returns io.EOF, and io.ErrUnexpectedEOF for a partial frame running
+// to the end. A corrupt frame is reported with its size, if known.
+func decode(rd io.Reader, left int64) ([]op, int64, error) {
+
+	if left == 0 {
+		return nil, 0, io.EOF
+	}
+
+	var head [8]byte
+	if left < int64(len(head)) {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+	if _, err := io.ReadFull(rd, head[:]); err != nil {
+		return nil, 0, err
+	}
+	left -= int64(len(head))
+
+	length := int64(binary.BigEndian.Uint32(head[0:4]))
+
+	if length > left {
+		rest := make([]byte, left)
+		if _, err := io.ReadFull(rd, rest); err != nil {
+			return nil, 0, err
+		}
+		if !partial(rest) {
+			return nil, 0, fmt.Errorf("Frame length %d exceeds the %d bytes left", length, left)
+		}
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(rd, payload); err != nil {
+		return nil, 0, err
+	}
+
+	size := int64(len(head) + len(payload))
+
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(head[4:8]) {
+		return nil, size, errors.New("Frame checksum mismatch")
+	}
+
+	var ops []op
+	buf := bytes.NewReader(payload)
+
+	readBytes := func() ([]byte, error) {
+		l, err := binary.ReadUvarint(buf)
+		if err != nil {
+			return nil, err
+		}
+		if l > uint64(buf.Len()) {
+			return nil, io.ErrUnexpectedEOF
+		}
+		b := make([]byte, l)
+		_, err = io.ReadFull(buf, b)
+		return b, err
+	}
+
+	for buf.Len() > 0 {
+
+		code, _ := buf.ReadByte()
+
+		key, err := readBytes()
+		if err != nil {
+			return nil, size, fmt.Errorf("Malformed frame: %s", err)
+		}
+
+		o := op{code: code, key: string(key)}
+
+		switch code {
+		case opPut:
+			if o.value, err = readBytes(); err != nil {
+				return nil, size, fmt.Errorf("Malformed frame: %s", err)
+			}
+		case opDel:
+		default:
+			return nil, size, fmt.Errorf("Unknown operation %q", code)
+		}
+
+		ops = append(ops, o)
+	}
+
+	return ops, size, nil
+}
+
+// partial tells if the payload is a prefix of well-formed operations,
+// as a frame cut short by a crash is, unlike the frames after a bad length
+func partial(payload []byte) bool {
+
+	buf := bytes.NewReader(payload)
+
+	skip := func() bool {
+		l, err := binary.ReadUvarint(buf)
+		if err != nil {
+			return err == io.EOF || err == io.ErrUnexpectedEOF
+		}
+		if l > uint64(buf.Len()) {
+			l = uint64(buf.Len())
+		}
+		buf.Seek(int64(l), io.SeekCurrent)
+		return true
+	}
+
+	for buf.Len() > 0 {
+
+		code, _ := buf.ReadByte()
+		if code != opPut && code != opDel {
+			return false
+		}
+
+		if !skip() {
+			return false
+		}
+		if code == opPut && !skip() {
+			return false
+		}
+	}
+
+	return true
+}
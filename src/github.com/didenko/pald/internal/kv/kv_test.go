@@ -0,0 +1,268 @@
+/*
+	(c) Copyright 2015 Vlad Didenko
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	    http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package kv
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+)
+
+func dumpDB(t *testing.T, db *DB) map[string]string {
+	m := make(map[string]string)
+	err := db.View(func(tx *Tx) error {
+		return tx.ForEach(func(k, v []byte) error {
+			m[string(k)] = string(v)
+			return nil
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestUpdateReopen(t *testing.T) {
+	name := "./kv_reopen.test"
+	defer os.Remove(name)
+
+	db, err := Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.Update(func(tx *Tx) error {
+		tx.Put([]byte("a"), []byte("1"))
+		tx.Put([]byte("b"), []byte("2"))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.Update(func(tx *Tx) error {
+		tx.Delete([]byte("a"))
+		tx.Put([]byte("c"), nil)
+		return errors.New("rollback")
+	})
+	if err == nil {
+		t.Error("Update should pass the error through")
+	}
+
+	err = db.Update(func(tx *Tx) error {
+		tx.Delete([]byte("b"))
+		tx.Put([]byte("c"), []byte("3"))
+		if v := tx.Get([]byte("c")); string(v) != "3" {
+			t.Errorf("A transaction should see its own writes, got %q", v)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db.Close()
+
+	db, err = Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if m := dumpDB(t, db); len(m) != 2 || m["a"] != "1" || m["c"] != "3" {
+		t.Errorf("Unexpected content after reopening: %v", m)
+	}
+}
+
+func TestTornTail(t *testing.T) {
+	name := "./kv_torn.test"
+	defer os.Remove(name)
+
+	db, err := Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db.Update(func(tx *Tx) error { return tx.Put([]byte("a"), []byte("1")) })
+	db.Update(func(tx *Tx) error { return tx.Put([]byte("b"), []byte("2")) })
+	size := db.size
+	db.Close()
+
+	if err = os.Truncate(name, size-1); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = OpenReadOnly(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m := dumpDB(t, db); len(m) != 1 || m["a"] != "1" {
+		t.Errorf("Only the first transaction should be read, got: %v", m)
+	}
+	if err = db.Update(func(tx *Tx) error { return nil }); err != ErrReadOnly {
+		t.Errorf("Expected a read-only store to refuse updates, got %v", err)
+	}
+	db.Close()
+
+	if info, _ := os.Stat(name); info.Size() != size-1 {
+		t.Errorf("A read-only open changed the journal size from %d to %d", size-1, info.Size())
+	}
+
+	db, err = Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if m := dumpDB(t, db); len(m) != 1 || m["a"] != "1" {
+		t.Errorf("Only the first transaction should survive, got: %v", m)
+	}
+
+	err = db.Update(func(tx *Tx) error { return tx.Put([]byte("c"), []byte("3")) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	db, err = Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if m := dumpDB(t, db); len(m) != 2 || m["c"] != "3" {
+		t.Errorf("Writes after a torn tail are lost: %v", m)
+	}
+}
+
+func TestCompact(t *testing.T) {
+	name := "./kv_compact.test"
+	defer os.Remove(name)
+
+	db, err := Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	value := make([]byte, 1024)
+	for i := 0; i < 2*compactMin/len(value); i++ {
+		db.Update(func(tx *Tx) error { return tx.Put([]byte("k"), value) })
+	}
+	db.Close()
+
+	db, err = Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if db.size > compactMin {
+		t.Errorf("The journal of %d bytes should have been compacted", db.size)
+	}
+
+	if m := dumpDB(t, db); len(m) != 1 || len(m["k"]) != len(value) {
+		t.Error("Compaction lost data")
+	}
+}
+
+func TestCorrupt(t *testing.T) {
+	name := "./kv_corrupt.test"
+	defer os.Remove(name)
+
+	db, err := Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db.Update(func(tx *Tx) error { return tx.Put([]byte("a"), []byte("1")) })
+	first := db.size
+	db.Update(func(tx *Tx) error { return tx.Put([]byte("b"), []byte("2")) })
+	second := db.size
+	db.Update(func(tx *Tx) error { return tx.Put([]byte("c"), []byte("3")) })
+	db.Close()
+
+	flip := func(offset int64) {
+		f, err := os.OpenFile(name, os.O_RDWR, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+
+		b := make([]byte, 1)
+		f.ReadAt(b, offset)
+		b[0] ^= 0xff
+		f.WriteAt(b, offset)
+	}
+
+	// The payload of the last frame is corrupt, as if torn
+	info, _ := os.Stat(name)
+	flip(info.Size() - 1)
+
+	db, err = Open(name)
+	if err != nil {
+		t.Fatalf("A corrupt last transaction should be discarded, got %v", err)
+	}
+	if m := dumpDB(t, db); len(m) != 2 || m["b"] != "2" {
+		t.Errorf("Only the corrupt last transaction should be lost, got: %v", m)
+	}
+	db.Close()
+
+	if info, _ = os.Stat(name); info.Size() != second {
+		t.Errorf("The journal of %d bytes should have been cut to %d", info.Size(), second)
+	}
+
+	// The payload of the first frame is corrupt, with the second after it
+	flip(first - 1)
+
+	_, err = Open(name)
+	if err == nil || !strings.Contains(err.Error(), fmt.Sprintf("offset %d", len(magic))) {
+		t.Errorf("A corrupt transaction followed by others should fail with its offset, got %v", err)
+	}
+}
+
+func TestBadLength(t *testing.T) {
+	name := "./kv_length.test"
+	defer os.Remove(name)
+
+	db, err := Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db.Update(func(tx *Tx) error { return tx.Put([]byte("a"), []byte("1")) })
+	db.Update(func(tx *Tx) error { return tx.Put([]byte("b"), []byte("2")) })
+	db.Update(func(tx *Tx) error { return tx.Put([]byte("c"), []byte("3")) })
+	size := db.size
+	db.Close()
+
+	f, err := os.OpenFile(name, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteAt([]byte{0x7f}, int64(len(magic)))
+	f.Close()
+
+	_, err = Open(name)
+	if err == nil || !strings.Contains(err.Error(), fmt.Sprintf("offset %d", len(magic))) {
+		t.Errorf("A frame with a bad length should fail with its offset, got %v", err)
+	}
+
+	if info, _ := os.Stat(name); info.Size() != size {
+		t.Errorf("The journal of %d bytes should not have been cut to %d", size, info.Size())
+	}
+}
@@ -0,0 +1,106 @@
+/*
+	(c) Copyright 2015 Vlad Didenko
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	    http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+// Package lock guards a resource against concurrent use by
+// several processes with an advisory lock on a PID file.
+package lock
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Lock is an exclusive advisory lock on a file keeping the holder's PID
+type Lock struct {
+	file *os.File
+}
+
+// HeldError is returned when the lock is held by another process
+type HeldError struct {
+	Name string
+	PID  int
+}
+
+func (he *HeldError) Error() string {
+	if he.PID == 0 {
+		return fmt.Sprintf("File %q is locked by another process", he.Name)
+	}
+	return fmt.Sprintf("File %q is locked by the process %d", he.Name, he.PID)
+}
+
+// Acquire takes the lock on the named file without waiting
+func Acquire(name string) (*Lock, error) {
+
+	file, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0660)
+	if err != nil {
+		return nil, err
+	}
+
+	err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		content, _ := ioutil.ReadAll(file)
+		file.Close()
+		pid, _ := strconv.Atoi(strings.TrimSpace(string(content)))
+		return nil, &HeldError{name, pid}
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	if err = file.Truncate(0); err == nil {
+		_, err = file.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return &Lock{file}, nil
+}
+
+// Wait takes the lock on the named file, retrying while it is held
+// by another process until the context is done
+func Wait(ctx context.Context, name string) (*Lock, error) {
+
+	for {
+		l, err := Acquire(name)
+
+		var held *HeldError
+		if !errors.As(err, &held) {
+			return l, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, err
+		case <-time.After(20 * time.Millisecond):
+		}
+	}
+}
+
+// Release clears the PID and releases the lock
+func (l *Lock) Release() error {
+	l.file.Truncate(0)
+	return l.file.Close()
+}
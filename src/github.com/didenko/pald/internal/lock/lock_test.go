@@ -0,0 +1,74 @@
+/*
+	(c) Copyright 2015 Vlad Didenko
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	    http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package lock
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestAcquire(t *testing.T) {
+	name := "./lock.test"
+	defer os.Remove(name)
+
+	l, err := Acquire(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = Acquire(name)
+	if he, ok := err.(*HeldError); !ok || he.PID != os.Getpid() {
+		t.Errorf("Expected the lock to be held by this process, got %v", err)
+	}
+
+	if err = l.Release(); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err = Acquire(name)
+	if err != nil {
+		t.Fatal("Failed to take a released lock:", err)
+	}
+	l.Release()
+}
+
+func TestWait(t *testing.T) {
+	name := "./wait.test"
+	defer os.Remove(name)
+
+	held, err := Acquire(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	if _, err = Wait(ctx, name); err == nil {
+		t.Fatal("Expected the held lock to time out")
+	}
+
+	time.AfterFunc(50*time.Millisecond, func() { held.Release() })
+
+	l, err := Wait(context.Background(), name)
+	if err != nil {
+		t.Fatal("Failed to wait for the lock:", err)
+	}
+	l.Release()
+}
@@ -0,0 +1,105 @@
+/*
+	(c) Copyright 2015 Vlad Didenko
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	    http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+// Package logging sets up the structured logger shared by all
+// the parts of the daemon.
+package logging
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+)
+
+var (
+	mu   sync.Mutex
+	file *os.File
+)
+
+// Validate checks the format and the level Setup takes
+func Validate(format, level string) error {
+
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return fmt.Errorf("Unknown log level %q", level)
+	}
+
+	switch strings.ToLower(format) {
+	case "", "logfmt", "json":
+		return nil
+	}
+
+	return fmt.Errorf("Unknown log format %q", format)
+}
+
+// Setup directs the default logger to the destination, which is
+// "stderr", "stdout" or a file name to append to. The format is
+// either "logfmt" or "json". Records below the level, one of "debug",
+// "info", "warn" or "error", are dropped. It can be called again to
+// change the settings, closing the previous log file if any.
+func Setup(format, level, dest string) error {
+
+	if err := Validate(format, level); err != nil {
+		return err
+	}
+
+	var lvl slog.Level
+	lvl.UnmarshalText([]byte(level))
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	var (
+		w      io.Writer
+		opened *os.File
+	)
+
+	switch dest {
+	case "", "stderr":
+		w = os.Stderr
+	case "stdout":
+		w = os.Stdout
+	default:
+		f, err := os.OpenFile(dest, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+		if err != nil {
+			return err
+		}
+		w, opened = f, f
+	}
+
+	opts := &slog.HandlerOptions{Level: lvl}
+
+	var handler slog.Handler
+
+	switch strings.ToLower(format) {
+	case "", "logfmt":
+		handler = slog.NewTextHandler(w, opts)
+	default: // json
+		handler = slog.NewJSONHandler(w, opts)
+	}
+
+	slog.SetDefault(slog.New(handler))
+
+	if file != nil {
+		file.Close()
+	}
+	file = opened
+
+	return nil
+}
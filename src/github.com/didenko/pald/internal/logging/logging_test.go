@@ -0,0 +1,67 @@
+/*
+	(c) Copyright 2015 Vlad Didenko
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	    http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package logging
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestSetup(t *testing.T) {
+	name := "./logging.test"
+	defer os.Remove(name)
+
+	if err := Setup("json", "warn", name); err != nil {
+		t.Fatal(err)
+	}
+
+	slog.Info("dropped")
+	slog.Warn("kept", "port", 49201)
+
+	if err := Setup("logfmt", "info", "stderr"); err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("Expected a single record, got %q", content)
+	}
+
+	var record map[string]interface{}
+	if err = json.Unmarshal([]byte(lines[0]), &record); err != nil {
+		t.Fatal(err)
+	}
+	if record["msg"] != "kept" || record["level"] != "WARN" || record["port"] != 49201.0 {
+		t.Errorf("Unexpected record %q", lines[0])
+	}
+
+	if err = Setup("xml", "info", "stderr"); err == nil {
+		t.Error("An unknown format should fail")
+	}
+	if err = Setup("json", "loud", "stderr"); err == nil {
+		t.Error("An unknown level should fail")
+	}
+}
@@ -0,0 +1,301 @@
+/*
+	(c) Copyright 2015 Vlad Didenko
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	    http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+// Package metrics keeps counters, gauges and histograms and
+// exposes them in the Prometheus text format.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefBuckets are the default histogram buckets, in seconds
+var DefBuckets = []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5}
+
+type family interface {
+	write(w *bufio.Writer)
+}
+
+var (
+	mu       sync.Mutex
+	families []family
+	names    = make(map[string]bool)
+)
+
+func register(name string, f family) {
+	mu.Lock()
+	defer mu.Unlock()
+	if names[name] {
+		panic(fmt.Sprintf("Metric %q is registered twice", name))
+	}
+	names[name] = true
+	families = append(families, f)
+}
+
+// WriteTo writes all the registered metrics in the Prometheus
+// text exposition format
+func WriteTo(w io.Writer) error {
+
+	mu.Lock()
+	fs := append([]family(nil), families...)
+	mu.Unlock()
+
+	buf := bufio.NewWriter(w)
+	for _, f := range fs {
+		f.write(buf)
+	}
+	return buf.Flush()
+}
+
+// vec keeps values of a metric per set of label values
+type vec struct {
+	sync.Mutex
+	name   string
+	help   string
+	kind   string
+	labels []string
+	values map[string]float64
+}
+
+func newVec(name, help, kind string, labels []string) *vec {
+	v := &vec{name: name, help: help, kind: kind, labels: labels, values: make(map[string]float64)}
+	if len(labels) == 0 {
+		v.values[""] = 0
+	}
+	register(name, v)
+	return v
+}
+
+func (v *vec) key(values []string) string {
+	if len(values) != len(v.labels) {
+		panic(fmt.Sprintf("Metric %q takes %d label values, got %d", v.name, len(v.labels), len(values)))
+	}
+	return formatLabels(v.labels, values)
+}
+
+func (v *vec) write(w *bufio.Writer) {
+	v.Lock()
+	defer v.Unlock()
+
+	header(w, v.name, v.help, v.kind)
+	for _, k := range sortedKeys(v.values) {
+		fmt.Fprintf(w, "%s%s %s\n", v.name, k, formatValue(v.values[k]))
+	}
+}
+
+// Counter is a value which only goes up
+type Counter struct {
+	*vec
+}
+
+// NewCounter registers a counter with the given label names
+func NewCounter(name, help string, labels ...string) *Counter {
+	return &Counter{newVec(name, help, "counter", labels)}
+}
+
+// Inc adds one for the label values
+func (c *Counter) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+// Add adds a non-negative delta for the label values
+func (c *Counter) Add(delta float64, values ...string) {
+	if delta < 0 {
+		panic("Counter can not go down")
+	}
+	k := c.key(values)
+	c.Lock()
+	c.values[k] += delta
+	c.Unlock()
+}
+
+// Gauge is a value which can go up and down
+type Gauge struct {
+	*vec
+}
+
+// NewGauge registers a gauge with the given label names
+func NewGauge(name, help string, labels ...string) *Gauge {
+	return &Gauge{newVec(name, help, "gauge", labels)}
+}
+
+// Set sets the value for the label values
+func (g *Gauge) Set(value float64, values ...string) {
+	k := g.key(values)
+	g.Lock()
+	g.values[k] = value
+	g.Unlock()
+}
+
+// GaugeFunc is a gauge which values are collected on every scrape
+type GaugeFunc struct {
+	name    string
+	help    string
+	labels  []string
+	collect func() map[string]float64
+}
+
+// NewGaugeFunc registers a gauge with a single label. The collect
+// function returns the gauge values keyed by the label value.
+func NewGaugeFunc(name, help, label string, collect func() map[string]float64) *GaugeFunc {
+	g := &GaugeFunc{name, help, []string{label}, collect}
+	register(name, g)
+	return g
+}
+
+func (g *GaugeFunc) write(w *bufio.Writer) {
+	header(w, g.name, g.help, "gauge")
+	values := make(map[string]float64)
+	for lv, v := range g.collect() {
+		values[formatLabels(g.labels, []string{lv})] = v
+	}
+	for _, k := range sortedKeys(values) {
+		fmt.Fprintf(w, "%s%s %s\n", g.name, k, formatValue(values[k]))
+	}
+}
+
+// Histogram counts observations in cumulative buckets
+type Histogram struct {
+	sync.Mutex
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+	series  map[string]*series
+}
+
+type series struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// NewHistogram registers a histogram with the upper bounds
+// of the buckets in the increasing order
+func NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	h := &Histogram{
+		name:    name,
+		help:    help,
+		labels:  labels,
+		buckets: buckets,
+		series:  make(map[string]*series),
+	}
+	register(name, h)
+	return h
+}
+
+// Observe adds the value for the label values
+func (h *Histogram) Observe(value float64, values ...string) {
+
+	if len(values) != len(h.labels) {
+		panic(fmt.Sprintf("Metric %q takes %d label values, got %d", h.name, len(h.labels), len(values)))
+	}
+	k := strings.Join(values, "\xff")
+
+	h.Lock()
+	defer h.Unlock()
+
+	s, ok := h.series[k]
+	if !ok {
+		s = &series{counts: make([]uint64, len(h.buckets))}
+		h.series[k] = s
+	}
+
+	for i, le := range h.buckets {
+		if value <= le {
+			s.counts[i]++
+		}
+	}
+	s.count++
+	s.sum += value
+}
+
+func (h *Histogram) write(w *bufio.Writer) {
+	h.Lock()
+	defer h.Unlock()
+
+	header(w, h.name, h.help, "histogram")
+
+	keys := make([]string, 0, len(h.series))
+	for k := range h.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		s := h.series[k]
+
+		var values []string
+		if len(h.labels) > 0 {
+			values = strings.Split(k, "\xff")
+		}
+
+		labels := append(append([]string(nil), h.labels...), "le")
+		for i, le := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name,
+				formatLabels(labels, append(append([]string(nil), values...), formatValue(le))), s.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name,
+			formatLabels(labels, append(append([]string(nil), values...), "+Inf")), s.count)
+
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, formatLabels(h.labels, values), formatValue(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, values), s.count)
+	}
+}
+
+func header(w *bufio.Writer, name, help, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, kind)
+}
+
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	escape := strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+	pairs := make([]string, len(names))
+	for i, n := range names {
+		pairs[i] = n + `="` + escape.Replace(values[i]) + `"`
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	default:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	}
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,68 @@
+/*
+	(c) Copyright 2015 Vlad Didenko
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	    http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package metrics
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestWriteTo(t *testing.T) {
+
+	c := NewCounter("test_total", "A test counter", "reason")
+	g := NewGauge("test_gauge", "A test gauge")
+	NewGaugeFunc("test_func", "A test gauge func", "pool", func() map[string]float64 {
+		return map[string]float64{"b": 2, "a": 1}
+	})
+	h := NewHistogram("test_seconds", "A test histogram", []float64{0.1, 1}, "handler")
+
+	c.Inc("x\"y")
+	c.Add(2, "a")
+	g.Set(1.5)
+	h.Observe(0.05, "get")
+	h.Observe(0.5, "get")
+	h.Observe(5, "get")
+
+	var buf bytes.Buffer
+	if err := WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `# HELP test_total A test counter
+# TYPE test_total counter
+test_total{reason="a"} 2
+test_total{reason="x\"y"} 1
+# HELP test_gauge A test gauge
+# TYPE test_gauge gauge
+test_gauge 1.5
+# HELP test_func A test gauge func
+# TYPE test_func gauge
+test_func{pool="a"} 1
+test_func{pool="b"} 2
+# HELP test_seconds A test histogram
+# TYPE test_seconds histogram
+test_seconds_bucket{handler="get",le="0.1"} 1
+test_seconds_bucket{handler="get",le="1"} 2
+test_seconds_bucket{handler="get",le="+Inf"} 3
+test_seconds_sum{handler="get"} 5.55
+test_seconds_count{handler="get"} 3
+`
+
+	if buf.String() != expected {
+		t.Errorf("Unexpected exposition:\n%s", buf.String())
+	}
+}
@@ -0,0 +1,66 @@
+/*
+	(c) Copyright 2015 Vlad Didenko
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	    http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package persist
+
+import (
+	"io"
+	"os"
+)
+
+// File is a backend keeping the registry dump in a single seekable stream
+type File struct {
+	rwst RWST
+}
+
+// NewFile creates a backend over an already open stream
+func NewFile(rwst RWST) *File {
+	return &File{rwst}
+}
+
+// OpenFile opens or creates the named dump file as a backend
+func OpenFile(name string) (*File, error) {
+	dump, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0660)
+	if err != nil {
+		return nil, err
+	}
+	return NewFile(dump), nil
+}
+
+func (f *File) Load(dst Loader) error {
+	if _, err := f.rwst.Seek(0, 0); err != nil {
+		return err
+	}
+	return dst.Load(f.rwst)
+}
+
+func (f *File) Save(src Dumper) error {
+	if _, err := f.rwst.Seek(0, 0); err != nil {
+		return err
+	}
+	if err := f.rwst.Truncate(0); err != nil {
+		return err
+	}
+	_, err := src.Dump(f.rwst)
+	return err
+}
+
+func (f *File) Close() error {
+	if c, ok := f.rwst.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
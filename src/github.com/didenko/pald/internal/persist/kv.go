@@ -0,0 +1,101 @@
+/*
+	(c) Copyright 2015 Vlad Didenko
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	    http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package persist
+
+import (
+	"bufio"
+	"bytes"
+
+	"github.com/didenko/pald/internal/kv"
+)
+
+// KV is a backend keeping every dumped line as a separate key in an
+// embedded key-value store. Each Save writes the lines changed since
+// the previous one as a single transaction, so either all or none
+// of them survive a crash. The changes made between two saves land
+// in the same transaction, as they are found by comparing the dumps.
+type KV struct {
+	db *kv.DB
+}
+
+// OpenKV opens or creates the named key-value store file as a backend
+func OpenKV(name string) (*KV, error) {
+	db, err := kv.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &KV{db}, nil
+}
+
+func (k *KV) Load(dst Loader) error {
+
+	var buf bytes.Buffer
+
+	err := k.db.View(func(tx *kv.Tx) error {
+		return tx.ForEach(func(key, _ []byte) error {
+			buf.Write(key)
+			buf.WriteByte('\n')
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	return dst.Load(&buf)
+}
+
+func (k *KV) Save(src Dumper) error {
+
+	var buf bytes.Buffer
+
+	if _, err := src.Dump(&buf); err != nil {
+		return err
+	}
+
+	lines := make(map[string]bool)
+	scanner := bufio.NewScanner(&buf)
+	for scanner.Scan() {
+		lines[scanner.Text()] = true
+	}
+
+	return k.db.Update(func(tx *kv.Tx) error {
+
+		err := tx.ForEach(func(key, _ []byte) error {
+			if lines[string(key)] {
+				delete(lines, string(key))
+				return nil
+			}
+			return tx.Delete(key)
+		})
+		if err != nil {
+			return err
+		}
+
+		for line := range lines {
+			if err := tx.Put([]byte(line), nil); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+func (k *KV) Close() error {
+	return k.db.Close()
+}
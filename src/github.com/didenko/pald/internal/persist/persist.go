@@ -17,8 +17,14 @@
 package persist
 
 import (
+	"fmt"
 	"io"
+	"log/slog"
+	"os"
+	"sync"
 	"time"
+
+	"github.com/didenko/pald/internal/kv"
 )
 
 type Dumper interface {
@@ -34,38 +40,151 @@ type Loader interface {
 	Load(r io.Reader) (err error)
 }
 
-func Persist(src Dumper, dst RWST, throttle time.Duration) chan struct{} {
+// Backend is a storage keeping the registry state between restarts
+type Backend interface {
+
+	// Load feeds the persisted state into dst
+	Load(dst Loader) error
 
-	defer src.Dump(dst)
+	// Save replaces the persisted state with the current state of src
+	Save(src Dumper) error
+
+	// Close releases the underlying storage
+	Close() error
+}
 
-	knob := make(chan struct{}, 10)
+// Open creates a backend of the named kind at the location
+func Open(kind, location string) (Backend, error) {
+	switch kind {
+	case "file":
+		return OpenFile(location)
+	case "kv":
+		return OpenKV(location)
+	default:
+		return nil, fmt.Errorf("Unknown storage kind %q", kind)
+	}
+}
+
+// OpenReadOnly opens an existing backend of the named kind at the
+// location without changing it. Saving to it fails.
+func OpenReadOnly(kind, location string) (Backend, error) {
+	switch kind {
+	case "file":
+		dump, err := os.Open(location)
+		if err != nil {
+			return nil, err
+		}
+		return NewFile(dump), nil
+	case "kv":
+		db, err := kv.OpenReadOnly(location)
+		if err != nil {
+			return nil, err
+		}
+		return &KV{db}, nil
+	default:
+		return nil, fmt.Errorf("Unknown storage kind %q", kind)
+	}
+}
+
+// Persister saves the state of a registry on request
+type Persister struct {
+	mu     sync.Mutex
+	knob   chan struct{}
+	closed bool
+	done   chan struct{}
+}
+
+// Persist saves the src state into the dst backend every time Flush
+// is called, but not more often than throttle. A Flush called sooner
+// delays the save until the throttle expires, so that the last change
+// is always saved. The state is saved once immediately.
+func Persist(src Dumper, dst Backend, throttle time.Duration) *Persister {
+
+	defer save(src, dst)
+
+	p := &Persister{
+		knob: make(chan struct{}, 10),
+		done: make(chan struct{}),
+	}
 
 	go func() {
 
-		for {
+		defer close(p.done)
 
-			last := time.Now()
+		last := time.Now()
 
+		var (
+			timer   *time.Timer
+			pending <-chan time.Time
+		)
+
+		for {
 			select {
 
-			case _, ok := <-knob:
+			case _, ok := <-p.knob:
 				if !ok {
-					break
+					if timer != nil {
+						timer.Stop()
+						save(src, dst)
+					}
+					return
+				}
+
+				if pending != nil {
+					continue
 				}
 
-				if time.Since(last) > throttle {
-					dst.Seek(0, 0)
-					dst.Truncate(0)
-					src.Dump(dst)
+				if wait := throttle - time.Since(last); wait > 0 {
+					timer = time.NewTimer(wait)
+					pending = timer.C
+					continue
 				}
+
+			case <-pending:
+				timer, pending = nil, nil
 			}
+
+			save(src, dst)
+			last = time.Now()
 		}
 	}()
 
-	return knob
+	return p
+}
+
+// Flush requests a save. It never blocks, as a save is
+// already due while earlier requests are queued.
+func (p *Persister) Flush() {
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return
+	}
+
+	select {
+	case p.knob <- struct{}{}:
+	default:
+	}
+}
+
+// Close stops saving. It makes the save requested and not done yet,
+// if any, and returns once nothing is saved to the backend anymore.
+func (p *Persister) Close() {
+
+	p.mu.Lock()
+	if !p.closed {
+		p.closed = true
+		close(p.knob)
+	}
+	p.mu.Unlock()
+
+	<-p.done
 }
 
-func Load(src RWST, dst Loader) error {
-	src.Seek(0, 0)
-	return dst.Load(src)
+func save(src Dumper, dst Backend) {
+	if err := dst.Save(src); err != nil {
+		slog.Error("Failed to persist the registry", "err", err)
+	}
 }
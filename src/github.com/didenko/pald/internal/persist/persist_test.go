@@ -17,6 +17,7 @@
 package persist
 
 import (
+	"os"
 	"testing"
 	"time"
 
@@ -27,44 +28,60 @@ func TestPersist(t *testing.T) {
 	r, _ := registry.New(0, 10)
 	s := new(StringRWST)
 	d := 100 * time.Millisecond
-	var b struct{}
-
-	flush := Persist(r, s, d)
+	p := Persist(r, NewFile(s), d)
 
 	if s.Get() != "" {
 		t.Error("Persistence test setup failed")
 	}
 
 	_, _ = r.Alloc("svc_0")
-	flush <- b
+	p.Flush()
+	time.Sleep(20 * time.Millisecond)
 
 	if s.Get() != "" {
-		t.Error("Flushing in under timeout should have not produce data")
+		t.Error("Flushing in under throttle should have delayed the save")
 	}
 
-	time.Sleep(200 * time.Millisecond) // wait for throttle to expire
-	flush <- b
-	time.Sleep(100 * time.Millisecond) // wait for Dump to happen in another goroutine
+	time.Sleep(150 * time.Millisecond) // wait for the delayed save
 
 	if w := s.Get(); w != "svc_0\t0\t\n" {
-		t.Errorf("A wrong string written. Received %q\n", w)
+		t.Errorf("The delayed save wrote a wrong string. Received %q\n", w)
 	}
 
-	flush <- b
+	time.Sleep(150 * time.Millisecond) // wait for throttle to expire
 	_, _ = r.Alloc("svc_1", "127.0.0.1", "::1")
-	flush <- b
+	p.Flush()
+	time.Sleep(20 * time.Millisecond) // wait for Dump to happen in another goroutine
 
-	if w := s.Get(); w != "svc_0\t0\t\n" {
-		t.Errorf("Flushing in under timeout should have not change data. Received %q\n", w)
+	if w := s.Get(); w != "svc_0\t0\t\nsvc_1\t1\t127.0.0.1,::1\n" {
+		t.Errorf("Flushing after throttle should have saved at once. Received %q\n", w)
 	}
 
-	time.Sleep(200 * time.Millisecond) // wait for throttle to expire
-	flush <- b
-	time.Sleep(100 * time.Millisecond) // wait for Dump to happen in another goroutine
+	_, _ = r.Alloc("svc_2")
+	p.Flush()
+	r.Forget(0)
+	p.Flush()
+	time.Sleep(20 * time.Millisecond)
 
 	if w := s.Get(); w != "svc_0\t0\t\nsvc_1\t1\t127.0.0.1,::1\n" {
-		t.Errorf("A wrong string written. Received %q\n", w)
+		t.Errorf("Flushing in under throttle should have not change data. Received %q\n", w)
+	}
+
+	time.Sleep(150 * time.Millisecond) // wait for the delayed save
+
+	if w := s.Get(); w != "svc_1\t1\t127.0.0.1,::1\nsvc_2\t2\t\n" {
+		t.Errorf("The delayed save lost the last change. Received %q\n", w)
+	}
+
+	r.Forget(1)
+	p.Flush()
+	p.Close()
+
+	if w := s.Get(); w != "svc_2\t2\t\n" {
+		t.Errorf("Closing should have made the delayed save. Received %q\n", w)
 	}
+
+	p.Flush()
 }
 
 func TestLoad(t *testing.T) {
@@ -76,7 +93,45 @@ func TestLoad(t *testing.T) {
 	_, _ = rBuild.Alloc("svc_1", "127.0.0.1", "::1")
 
 	rLoaded, _ := registry.New(0, 10)
-	if err := Load(s, rLoaded); err != nil {
+	if err := NewFile(s).Load(rLoaded); err != nil {
+		t.Fatal(err)
+	}
+
+	if !rBuild.Equal(rLoaded) {
+		t.Error("Build and loaded registries differ.\n", rBuild, "\n", rLoaded)
+	}
+}
+
+func TestKV(t *testing.T) {
+	name := "./persist_kv.test"
+	defer os.Remove(name)
+
+	store, err := OpenKV(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rBuild, _ := registry.New(0, 10)
+	_, _ = rBuild.Alloc("svc_0")
+	_, _ = rBuild.Alloc("svc_1", "127.0.0.1", "::1")
+	_, _ = rBuild.Alloc("svc_2")
+
+	p := Persist(rBuild, store, 0)
+
+	rBuild.Forget(2)
+	p.Flush()
+	p.Close()
+
+	store.Close()
+
+	store, err = OpenKV(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	rLoaded, _ := registry.New(0, 10)
+	if err := store.Load(rLoaded); err != nil {
 		t.Fatal(err)
 	}
 
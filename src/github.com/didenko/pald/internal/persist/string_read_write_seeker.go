@@ -19,9 +19,11 @@ package persist
 import (
 	"errors"
 	"io"
+	"sync"
 )
 
 type StringRWST struct {
+	mu  sync.Mutex
 	s   string
 	pos int
 }
@@ -29,16 +31,25 @@ type StringRWST struct {
 const maxint = int64(^uint(0) >> 1)
 
 func (sw *StringRWST) Write(p []byte) (n int, err error) {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+
 	sw.s = sw.s[:sw.pos] + string(p)
 	return len(p), nil
 }
 
 func (sw *StringRWST) Truncate(size int64) error {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+
 	sw.s = sw.s[:size]
 	return nil
 }
 
 func (sw *StringRWST) Seek(offset int64, whence int) (int64, error) {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+
 	var newOffset int64
 	switch whence {
 	case 0:
@@ -61,6 +72,9 @@ func (sw *StringRWST) Seek(offset int64, whence int) (int64, error) {
 }
 
 func (sw *StringRWST) Read(p []byte) (n int, err error) {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+
 	is, ip := 0, 0
 	next := false
 
@@ -79,10 +93,16 @@ func (sw *StringRWST) Read(p []byte) (n int, err error) {
 }
 
 func (sw *StringRWST) Get() string {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+
 	return sw.s
 }
 
 func (sw *StringRWST) Set(s string) {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+
 	sw.pos = 0
 	sw.s = s
 }
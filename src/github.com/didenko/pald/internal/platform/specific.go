@@ -33,3 +33,9 @@ type Config interface {
 func GetConfig() Config {
 	return platformConfig()
 }
+
+// GetConfigFor returns the locations of the named application,
+// e.g. for other programs to find the pald configuration
+func GetConfigFor(name string) Config {
+	return platformConfigFor(name)
+}
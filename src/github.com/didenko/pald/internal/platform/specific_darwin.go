@@ -57,6 +57,16 @@ func platformConfig() Config {
 	return &config
 }
 
+func platformConfigFor(name string) Config {
+
+	named := config
+
+	named.dir.system = "/Library/Application Support/" + name
+	named.dir.user = config.user.HomeDir + "/." + name
+
+	return &named
+}
+
 func (dc *darwinConfig) DirSystem() string {
 	return dc.dir.system
 }
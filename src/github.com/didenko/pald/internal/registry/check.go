@@ -0,0 +1,250 @@
+/*
+	(c) Copyright 2015 Vlad Didenko
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	    http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package registry
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+)
+
+// LoadPolicy defines what Load does with invalid records
+type LoadPolicy int
+
+const (
+	// LoadReject fails the whole Load on the first invalid record
+	LoadReject LoadPolicy = iota
+
+	// LoadSkip drops invalid records, reporting them as problems
+	LoadSkip
+
+	// LoadOrphan reports invalid records as problems and keeps
+	// them verbatim, so they are written back by Dump, but
+	// does not serve them
+	LoadOrphan
+)
+
+// ParseLoadPolicy converts the policy name as used in
+// the configuration into a LoadPolicy
+func ParseLoadPolicy(name string) (LoadPolicy, error) {
+	switch name {
+	case "reject":
+		return LoadReject, nil
+	case "skip":
+		return LoadSkip, nil
+	case "orphan":
+		return LoadOrphan, nil
+	default:
+		return 0, fmt.Errorf("Unknown load policy %q", name)
+	}
+}
+
+// RangePolicy defines what Load does with records outside of the port
+// range, such as left after the range was shrunk between restarts
+type RangePolicy int
+
+const (
+	// RangeKeep registers the records at their ports as grandfathered.
+	// Once released, those ports are not allocated again.
+	RangeKeep RangePolicy = iota
+
+	// RangeMigrate moves the records to free ports in the range,
+	// treating them as invalid if no free ports are left
+	RangeMigrate
+
+	// RangeDrop leaves the records out
+	RangeDrop
+)
+
+// ParseRangePolicy converts the policy name as used in
+// the configuration into a RangePolicy
+func ParseRangePolicy(name string) (RangePolicy, error) {
+	switch name {
+	case "keep":
+		return RangeKeep, nil
+	case "migrate":
+		return RangeMigrate, nil
+	case "drop":
+		return RangeDrop, nil
+	default:
+		return 0, fmt.Errorf("Unknown range policy %q", name)
+	}
+}
+
+// Fault is a kind of an invalid record
+type Fault string
+
+const (
+	FaultMalformed Fault = "malformed line"
+	FaultRange     Fault = "port out of range"
+	FaultDupName   Fault = "duplicate name"
+	FaultDupPort   Fault = "duplicate port"
+)
+
+// FaultError is returned for records which can not be registered
+type FaultError struct {
+	Fault  Fault
+	Detail string
+}
+
+func (fe *FaultError) Error() string {
+	return string(fe.Fault) + ": " + fe.Detail
+}
+
+func faultf(f Fault, format string, a ...interface{}) error {
+	return &FaultError{f, fmt.Sprintf(format, a...)}
+}
+
+// Problem describes an invalid or out of range record met by Load
+// and the action taken on it
+type Problem struct {
+	Line   int
+	Text   string
+	Fault  Fault
+	Detail string
+	Action string
+	svc    *service
+}
+
+func newProblem(line int, text string, err error, svc *service) Problem {
+	p := Problem{Line: line, Text: text, svc: svc}
+	p.setFault(err)
+	return p
+}
+
+func (p *Problem) setFault(err error) {
+	if fe, ok := err.(*FaultError); ok {
+		p.Fault, p.Detail = fe.Fault, fe.Detail
+	} else {
+		p.Detail = err.Error()
+	}
+}
+
+func (p Problem) String() string {
+	if p.Action == "" {
+		return fmt.Sprintf("line %d: %s: %s: %q", p.Line, p.Fault, p.Detail, p.Text)
+	}
+	return fmt.Sprintf("line %d: %s: %s: %q: %s", p.Line, p.Fault, p.Detail, p.Text, p.Action)
+}
+
+// SetLoadPolicy changes how the following Load calls treat invalid records
+func (r *Registry) SetLoadPolicy(p LoadPolicy) {
+	r.Lock()
+	defer r.Unlock()
+	r.policy = p
+}
+
+// SetRangePolicy changes how the following Load calls treat
+// records outside of the port range
+func (r *Registry) SetRangePolicy(p RangePolicy) {
+	r.Lock()
+	defer r.Unlock()
+	r.ranging = p
+}
+
+// SetRange changes the port range of the registry. Services left
+// outside of the new range, as well as orphaned records, are handled
+// by the range and load policies the same way Load does. If the load
+// policy rejects any of them, the registry is left unchanged.
+func (r *Registry) SetRange(min, max uint16) ([]Problem, error) {
+
+	if min > max {
+		return nil,
+			fmt.Errorf("Minimum port %d must be less than maximum port %d",
+				min, max)
+	}
+
+	r.Lock()
+	defer r.Unlock()
+
+	staged := r.stage(min, max)
+
+	var buf bytes.Buffer
+
+	if _, err := r.dump(&buf); err != nil {
+		return nil, err
+	}
+
+	if err := staged.load(&buf); err != nil {
+		return nil, err
+	}
+
+	for name, svc := range staged.byname {
+		if old, ok := r.byname[name]; ok && old.equal(svc) {
+			svc.since = old.since
+		}
+	}
+
+	replaced := r.byname
+	r.adopt(staged)
+	r.emitDiff(replaced, Origin{})
+	r.checkWatermarks()
+
+	return staged.problems, nil
+}
+
+// Problems returns invalid and out of range records met by the last Load
+func (r *Registry) Problems() []Problem {
+	r.RLock()
+	defer r.RUnlock()
+	return append([]Problem(nil), r.problems...)
+}
+
+// Fsck loads a dump from rd into a new registry with the given
+// boundaries and reports the problems found. Without fix the actions
+// of the problems are empty. With fix set, services rejected for their
+// port are moved into free ports where possible. Every other invalid
+// record is dropped, so dumping the returned registry produces
+// a repaired dump.
+func Fsck(rd io.Reader, min, max uint16, fix bool) (*Registry, []Problem, error) {
+
+	reg, err := New(min, max)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	reg.policy = LoadSkip
+	reg.ranging = RangeDrop
+
+	if err = reg.Load(rd); err != nil {
+		return nil, nil, err
+	}
+
+	for i, p := range reg.problems {
+
+		if !fix {
+			reg.problems[i].Action = ""
+			continue
+		}
+
+		reg.problems[i].Action = "dropped"
+
+		if p.Fault != FaultRange && p.Fault != FaultDupPort {
+			continue
+		}
+
+		port, err := reg.Alloc(p.svc.name, p.svc.addr...)
+		if err != nil {
+			reg.problems[i].Action = "dropped: " + err.Error()
+			continue
+		}
+
+		reg.problems[i].Action = fmt.Sprintf("moved to port %d", port)
+	}
+
+	return reg, reg.problems, nil
+}
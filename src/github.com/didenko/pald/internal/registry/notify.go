@@ -0,0 +1,173 @@
+/*
+	(c) Copyright 2015 Vlad Didenko
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	    http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package registry
+
+import (
+	"sort"
+	"strings"
+)
+
+// EventKind tells how a service changed
+type EventKind string
+
+const (
+	EventAlloc     EventKind = "alloc"
+	EventRelease   EventKind = "release"
+	EventWatermark EventKind = "watermark"
+)
+
+// Event is a change of a single service in the registry, or
+// a crossed utilization watermark. Moving a service to another
+// port is a release followed by an alloc.
+type Event struct {
+	Kind EventKind
+	Entry
+	Origin Origin
+
+	// Watermark is set for watermark events only
+	Watermark *Watermark
+}
+
+// Origin tells who made a change. An Origin with neither the caller
+// address nor the client name stands for the changes the daemon makes
+// itself, like applying the range policy.
+type Origin struct {
+	Caller string
+	Client string
+
+	// Import is set for the changes made by Import
+	Import bool
+}
+
+// Changes makes the registry changes on behalf of an origin,
+// passing it to the Notify functions with the events
+type Changes struct {
+	r *Registry
+	o Origin
+}
+
+// As returns the changes made on behalf of the origin
+func (r *Registry) As(o Origin) Changes {
+	return Changes{r, o}
+}
+
+// Alloc is Registry.Alloc on behalf of the origin
+func (c Changes) Alloc(name string, addr ...string) (uint16, error) {
+	return c.r.alloc(c.o, name, addr...)
+}
+
+// AllocAt is Registry.AllocAt on behalf of the origin
+func (c Changes) AllocAt(port uint16, name string, addr ...string) error {
+	return c.r.allocAt(c.o, port, name, addr...)
+}
+
+// Forget is Registry.Forget on behalf of the origin
+func (c Changes) Forget(port uint16) (string, bool) {
+	return c.r.forget(c.o, port)
+}
+
+// Import is Registry.Import on behalf of the origin
+func (c Changes) Import(snapshot []Entry, mode ImportMode) []Problem {
+	return c.r.importSnapshot(c.o, snapshot, mode)
+}
+
+// Notify adds a function to call on every change of the registry
+// after it is loaded: allocations, releases, imports, services
+// moved or dropped by SetRange, and crossed watermarks. Load only
+// reports the services the range policy moved or dropped. The
+// events carry the origin of the changes made through As. The
+// functions are called in the order of the changes while the
+// registry is locked, so they must be quick and must not use
+// the registry.
+func (r *Registry) Notify(fn func(Event)) {
+	r.Lock()
+	r.hooks = append(r.hooks, fn)
+	r.Unlock()
+}
+
+func (r *Registry) emit(kind EventKind, svc *service, o Origin) {
+	if len(r.hooks) == 0 {
+		return
+	}
+	ev := Event{Kind: kind, Entry: Entry{svc.name, svc.port, append([]string(nil), svc.addr...)}, Origin: o}
+	for _, fn := range r.hooks {
+		fn(ev)
+	}
+}
+
+// emitDiff emits the changes between the replaced services
+// and the current ones, releases first, each ordered by port
+func (r *Registry) emitDiff(replaced map[string]*service, o Origin) {
+
+	if len(r.hooks) == 0 {
+		return
+	}
+
+	var gone, came []*service
+
+	for name, old := range replaced {
+		if now, ok := r.byname[name]; !ok || !now.equal(old) {
+			gone = append(gone, old)
+		}
+	}
+
+	for name, now := range r.byname {
+		if old, ok := replaced[name]; !ok || !now.equal(old) {
+			came = append(came, now)
+		}
+	}
+
+	for _, svcs := range [][]*service{gone, came} {
+		sort.Slice(svcs, func(i, j int) bool { return svcs[i].port < svcs[j].port })
+	}
+
+	for _, svc := range gone {
+		r.emit(EventRelease, svc, o)
+	}
+	for _, svc := range came {
+		r.emit(EventAlloc, svc, o)
+	}
+}
+
+// emitRanged emits the stored services which the range policy moved
+// or dropped while loading, as released from their stored ports and,
+// if moved, allocated again, releases first
+func (r *Registry) emitRanged() {
+
+	if len(r.hooks) == 0 {
+		return
+	}
+
+	var moved []*service
+
+	for _, p := range r.problems {
+		if p.Fault != FaultRange || p.svc == nil {
+			continue
+		}
+		switch {
+		case p.Action == "dropped":
+			r.emit(EventRelease, p.svc, Origin{})
+		case strings.HasPrefix(p.Action, "moved"):
+			r.emit(EventRelease, p.svc, Origin{})
+			moved = append(moved, r.byname[p.svc.name])
+		}
+	}
+
+	for _, svc := range moved {
+		r.emit(EventAlloc, svc, Origin{})
+	}
+}
@@ -18,12 +18,28 @@ package registry
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"io"
+	"log/slog"
+	"reflect"
 	"strings"
 	"sync"
+	"time"
 )
 
+// ErrNoPorts is returned by Alloc when all ports in the range are taken
+var ErrNoPorts = errors.New("No ports available")
+
+// NameTakenError is returned by Alloc and Reserve for a registered name
+type NameTakenError struct {
+	Name string
+}
+
+func (e *NameTakenError) Error() string {
+	return fmt.Sprintf("Name %q is already taken", e.Name)
+}
+
 type Registry struct {
 	sync.RWMutex
 	byname   map[string]*service
@@ -31,6 +47,15 @@ type Registry struct {
 	portMin  uint16
 	portMax  uint16
 	portNext uint16
+	policy   LoadPolicy
+	ranging  RangePolicy
+	problems []Problem
+	orphans  []string
+	hooks    []func(Event)
+	reserved map[uint16]bool
+
+	watermarks []int
+	crossed    int
 }
 
 // Create New port registry with given boundaries
@@ -47,6 +72,9 @@ func New(min, max uint16) (*Registry, error) {
 		portMin:  min,
 		portMax:  max,
 		portNext: min,
+		policy:   LoadOrphan,
+		ranging:  RangeKeep,
+		reserved: make(map[uint16]bool),
 	}, nil
 }
 
@@ -69,6 +97,10 @@ func (r *Registry) Lookup(name string) (uint16, []string, error) {
 // the symbolic name is already registered or no more dynamic
 // ports available in the pool
 func (r *Registry) Alloc(name string, addr ...string) (uint16, error) {
+	return r.alloc(Origin{}, name, addr...)
+}
+
+func (r *Registry) alloc(o Origin, name string, addr ...string) (uint16, error) {
 
 	r.Lock()
 	defer r.Unlock()
@@ -76,7 +108,7 @@ func (r *Registry) Alloc(name string, addr ...string) (uint16, error) {
 	_, name_taken := r.byname[name]
 
 	if name_taken {
-		return 0, fmt.Errorf("Name %q is already taken", name)
+		return 0, &NameTakenError{name}
 	}
 
 	port, err := r.portFind()
@@ -87,25 +119,132 @@ func (r *Registry) Alloc(name string, addr ...string) (uint16, error) {
 
 	r.createSvc(port, name, addr...)
 
+	if port == r.portNext {
+		r.seekNext()
+	}
+
+	slog.Debug("Port allocated", "service", name, "port", port)
+	r.emit(EventAlloc, r.byport[port], o)
+	r.checkWatermarks()
+
 	return port, nil
 }
 
+// Reserve sets aside the port Alloc would assign to the name now,
+// without registering it. Alloc and Reserve skip the reserved ports
+// until the reservation ends with AllocAt or Unreserve.
+func (r *Registry) Reserve(name string) (uint16, error) {
+
+	r.Lock()
+	defer r.Unlock()
+
+	if _, name_taken := r.byname[name]; name_taken {
+		return 0, &NameTakenError{name}
+	}
+
+	port, err := r.portFind()
+	if err != nil {
+		return 0, err
+	}
+
+	r.reserved[port] = true
+
+	return port, nil
+}
+
+// Unreserve ends the reservation of the port without registering it
+func (r *Registry) Unreserve(port uint16) {
+
+	r.Lock()
+	defer r.Unlock()
+
+	delete(r.reserved, port)
+}
+
+// AllocAt registers the name at the port, which must be free and in
+// the range, ending its reservation either way. Together with Reserve
+// it allows deciding on allocations without holding the registry.
+// A reserved port may still be taken meanwhile by an import or moved
+// out of the range, failing with the FaultDupPort or FaultRange fault.
+func (r *Registry) AllocAt(port uint16, name string, addr ...string) error {
+	return r.allocAt(Origin{}, port, name, addr...)
+}
+
+func (r *Registry) allocAt(o Origin, port uint16, name string, addr ...string) error {
+
+	r.Lock()
+	defer r.Unlock()
+
+	delete(r.reserved, port)
+
+	if err := r.createSvc(port, name, addr...); err != nil {
+		return err
+	}
+
+	if port == r.portNext {
+		r.seekNext()
+	}
+
+	slog.Debug("Port allocated", "service", name, "port", port)
+	r.emit(EventAlloc, r.byport[port], o)
+	r.checkWatermarks()
+
+	return nil
+}
+
+// At returns the service registered at the port
+func (r *Registry) At(port uint16) (Entry, bool) {
+
+	r.RLock()
+	defer r.RUnlock()
+
+	svc, ok := r.byport[port]
+	if !ok {
+		return Entry{}, false
+	}
+
+	return Entry{svc.name, svc.port, append([]string(nil), svc.addr...)}, true
+}
+
 // Forget removes the service associated with the specified port.
-// If the port is not in the registry, no error generated.
-func (r *Registry) Forget(port uint16) {
+// If the port is not in the registry, no error generated. The
+// result is the name of the removed service and if there was one.
+func (r *Registry) Forget(port uint16) (string, bool) {
+	return r.forget(Origin{}, port)
+}
+
+func (r *Registry) forget(o Origin, port uint16) (string, bool) {
 
 	r.Lock()
 	defer r.Unlock()
 
-	if svc, ok := r.byport[port]; ok {
-		delete(r.byname, svc.name)
+	svc, ok := r.byport[port]
+	if !ok {
+		return "", false
 	}
 
+	delete(r.byname, svc.name)
 	delete(r.byport, port)
 
-	if port < r.portNext {
+	if port < r.portNext && port >= r.portMin {
 		r.portNext = port
 	}
+
+	slog.Debug("Port released", "service", svc.name, "port", port)
+	r.emit(EventRelease, svc, o)
+	r.checkWatermarks()
+
+	return svc.name, true
+}
+
+// Usage returns the number of ports in the range and
+// how many of them are allocated
+func (r *Registry) Usage() (size, used int) {
+
+	r.RLock()
+	defer r.RUnlock()
+
+	return r.usage()
 }
 
 // Dump writes out all registry's services
@@ -114,6 +253,11 @@ func (r *Registry) Dump(w io.Writer) (int, error) {
 	r.RLock()
 	defer r.RUnlock()
 
+	return r.dump(w)
+}
+
+func (r *Registry) dump(w io.Writer) (int, error) {
+
 	var (
 		wrote, n int = 0, 0
 		err      error
@@ -133,31 +277,160 @@ func (r *Registry) Dump(w io.Writer) (int, error) {
 			}
 		}
 	}
+
+	for _, line := range r.orphans {
+		n, err = fmt.Fprintln(buf, line)
+		wrote += n
+		if err != nil {
+			return wrote, err
+		}
+	}
+
 	return wrote, buf.Flush()
 }
 
-// Load reads all the services from r.
-func (reg *Registry) Load(r io.Reader) (err error) {
+// Load reads all the services from r. Invalid records are treated
+// according to the registry's load policy, see SetLoadPolicy, and
+// records outside of the port range according to the range policy,
+// see SetRangePolicy. The loaded services replace the registry
+// content. If loading fails, the registry is left unchanged.
+func (reg *Registry) Load(r io.Reader) error {
 
 	reg.Lock()
 	defer reg.Unlock()
 
+	staged := reg.stage(reg.portMin, reg.portMax)
+
+	if err := staged.load(r); err != nil {
+		return err
+	}
+
+	reg.adopt(staged)
+	reg.crossed = reg.level()
+	reg.emitRanged()
+
+	return nil
+}
+
+// stage returns an empty registry with the same policies
+// to load into before replacing the content with adopt
+func (reg *Registry) stage(min, max uint16) *Registry {
+	return &Registry{
+		byname:   make(map[string]*service, len(reg.byname)),
+		byport:   make(map[uint16]*service, len(reg.byport)),
+		portMin:  min,
+		portMax:  max,
+		portNext: min,
+		policy:   reg.policy,
+		ranging:  reg.ranging,
+	}
+}
+
+// adopt replaces the content of the registry with the staged one
+func (reg *Registry) adopt(staged *Registry) {
+	reg.byname = staged.byname
+	reg.byport = staged.byport
+	reg.portMin = staged.portMin
+	reg.portMax = staged.portMax
+	reg.portNext = staged.portNext
+	reg.orphans = staged.orphans
+	reg.problems = staged.problems
+}
+
+func (reg *Registry) load(r io.Reader) (err error) {
+
+	reg.problems = nil
+
+	var moving []Problem
+
 	scanner := bufio.NewScanner(r)
 
-	for scanner.Scan() {
+	for line := 1; scanner.Scan(); line++ {
 
-		service, err := parseSvc(scanner.Text())
-		if err != nil {
-			return err
+		text := scanner.Text()
+
+		service, err := parseSvc(text)
+		if err == nil && service == nil {
+			continue
+		}
+		if err == nil {
+			err = reg.setSvc(service, false)
+		}
+		if err == nil {
+			continue
+		}
+
+		problem := newProblem(line, text, err, service)
+
+		if problem.Fault == FaultRange {
+			switch reg.ranging {
+			case RangeKeep:
+				if err = reg.setSvc(service, true); err == nil {
+					problem.Action = "kept"
+					reg.problems = append(reg.problems, problem)
+					continue
+				}
+				problem.setFault(err)
+			case RangeMigrate:
+				moving = append(moving, problem)
+				continue
+			case RangeDrop:
+				problem.Action = "dropped"
+				reg.problems = append(reg.problems, problem)
+				continue
+			}
 		}
 
-		reg.setSvc(service)
+		if err = reg.refuse(problem); err != nil {
+			return err
+		}
 	}
 
 	if err := scanner.Err(); err != nil {
 		return err
 	}
 
+	// Migrating after all the records are in place,
+	// so that no valid record gets displaced
+	for _, problem := range moving {
+
+		port, err := reg.portFind()
+		if err == nil {
+			err = reg.createSvc(port, problem.svc.name, problem.svc.addr...)
+		}
+		if err == nil {
+			problem.Action = fmt.Sprintf("moved to port %d", port)
+			reg.problems = append(reg.problems, problem)
+			continue
+		}
+
+		problem.setFault(err)
+
+		if err = reg.refuse(problem); err != nil {
+			return err
+		}
+	}
+
+	reg.portNext = reg.portMin
+	reg.seekNext()
+
+	return nil
+}
+
+// refuse handles an invalid record according to the load policy
+func (reg *Registry) refuse(problem Problem) error {
+
+	switch reg.policy {
+	case LoadReject:
+		return fmt.Errorf("Line %d: %s: %s", problem.Line, problem.Fault, problem.Detail)
+	case LoadSkip:
+		problem.Action = "skipped"
+	case LoadOrphan:
+		problem.Action = "orphaned"
+		reg.orphans = append(reg.orphans, problem.Text)
+	}
+
+	reg.problems = append(reg.problems, problem)
 	return nil
 }
 
@@ -167,24 +440,50 @@ func (r *Registry) portFind() (uint16, error) {
 
 		_, taken := r.byport[p]
 
-		if !taken {
+		if !taken && !r.reserved[p] {
 			return p, nil
 		}
 	}
 
-	return 0, fmt.Errorf("No ports available")
+	return 0, ErrNoPorts
+}
+
+// seekNext moves portNext up to the lowest free port in the range,
+// or to the range maximum if there are no free ports
+func (r *Registry) seekNext() {
+	for p := r.portNext; p < r.portMax; p++ {
+		if _, taken := r.byport[p]; !taken {
+			r.portNext = p
+			return
+		}
+	}
+	r.portNext = r.portMax
 }
 
-func (r *Registry) setSvc(svc *service) error {
-	// check valid service values here
+// setSvc registers the service. Only grandfathered services
+// are allowed to have ports outside of the range.
+func (r *Registry) setSvc(svc *service, grandfathered bool) error {
+
+	if !grandfathered && (svc.port < r.portMin || svc.port > r.portMax) {
+		return faultf(FaultRange, "port %d is outside of [%d, %d]", svc.port, r.portMin, r.portMax)
+	}
+
+	if _, taken := r.byname[svc.name]; taken {
+		return faultf(FaultDupName, "name %q is already registered", svc.name)
+	}
+
+	if other, taken := r.byport[svc.port]; taken {
+		return faultf(FaultDupPort, "port %d is already registered to %q", svc.port, other.name)
+	}
+
 	r.byname[svc.name] = svc
 	r.byport[svc.port] = svc
 	return nil
 }
 
 func (r *Registry) createSvc(port uint16, name string, addr ...string) error {
-	svc := &service{port, name, addr}
-	return r.setSvc(svc)
+	svc := &service{port: port, name: name, addr: addr, since: time.Now()}
+	return r.setSvc(svc, false)
 }
 
 // Equal is used in testing only. It is made to be able to debug
@@ -196,7 +495,8 @@ func (r *Registry) Equal(rr *Registry) bool {
 		r.portMax != rr.portMax ||
 		r.portNext != rr.portNext ||
 		len(r.byport) != len(rr.byport) ||
-		len(r.byname) != len(rr.byname) {
+		len(r.byname) != len(rr.byname) ||
+		!reflect.DeepEqual(r.orphans, rr.orphans) {
 
 		return false
 	}
@@ -17,10 +17,12 @@
 package registry
 
 import (
+	"bytes"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -193,3 +195,223 @@ func mockRegistry(t *testing.T) *Registry {
 
 	return reg
 }
+
+var faultyText = `svc_a	3	
+# a comment
+
+svc_b	3	127.0.0.1
+svc_a	4	
+svc_c	20	
+svc_d	x5	
+svc_e	5	
+`
+
+func TestLoadPolicy(t *testing.T) {
+
+	reg, _ := New(1, 10)
+	reg.SetLoadPolicy(LoadReject)
+	if err := reg.Load(strings.NewReader(faultyText)); err == nil {
+		t.Error("Loading a faulty dump with the reject policy should fail")
+	}
+
+	faults := []Fault{FaultDupPort, FaultDupName, FaultRange, FaultMalformed}
+
+	for _, policy := range []LoadPolicy{LoadSkip, LoadOrphan} {
+
+		reg, _ = New(1, 10)
+		reg.SetLoadPolicy(policy)
+		reg.SetRangePolicy(RangeDrop)
+		if err := reg.Load(strings.NewReader(faultyText)); err != nil {
+			t.Fatal(err)
+		}
+
+		problems := reg.Problems()
+		if len(problems) != len(faults) {
+			t.Fatalf("Expected %d problems, got: %v", len(faults), problems)
+		}
+		for i, p := range problems {
+			if p.Fault != faults[i] || p.Line != i+4 {
+				t.Errorf("Unexpected problem %v", p)
+			}
+			if (p.Fault == FaultRange) != (p.Action == "dropped") {
+				t.Errorf("Unexpected action for %v", p)
+			}
+		}
+
+		if err := matches(reg, "svc_a", 3); err != nil {
+			t.Error(err)
+		}
+		if err := matches(reg, "svc_e", 5); err != nil {
+			t.Error(err)
+		}
+
+		var buf bytes.Buffer
+		reg.Dump(&buf)
+
+		expected := "svc_a\t3\t\nsvc_e\t5\t\n"
+		if policy == LoadOrphan {
+			expected += "svc_b\t3\t127.0.0.1\nsvc_a\t4\t\nsvc_d\tx5\t\n"
+		}
+		if buf.String() != expected {
+			t.Errorf("Policy %d dumped %q instead of %q", policy, buf.String(), expected)
+		}
+	}
+}
+
+func TestFsck(t *testing.T) {
+
+	reg, problems, err := Fsck(strings.NewReader(faultyText), 1, 10, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"moved to port 1", "dropped", "moved to port 2", "dropped"}
+	if len(problems) != len(expected) {
+		t.Fatalf("Unexpected problems %v", problems)
+	}
+	for i, p := range problems {
+		if p.Action != expected[i] {
+			t.Errorf("Unexpected action for %v, expected %q", p, expected[i])
+		}
+	}
+
+	var buf bytes.Buffer
+	reg.Dump(&buf)
+
+	if w := buf.String(); w != "svc_b\t1\t127.0.0.1\nsvc_c\t2\t\nsvc_a\t3\t\nsvc_e\t5\t\n" {
+		t.Errorf("Unexpected repaired dump %q", w)
+	}
+}
+
+func TestRangePolicy(t *testing.T) {
+
+	const dump = "svc_a\t1\t\nsvc_b\t5\t\nsvc_c\t7\t\nsvc_d\t20\t\n"
+
+	mocks := []struct {
+		policy  RangePolicy
+		actions []string
+		dumped  string
+		next    uint16
+	}{
+		{RangeKeep, []string{"kept", "kept"}, dump, 6},
+		{RangeMigrate, []string{"moved to port 6", "moved to port 8"}, "svc_b\t5\t\nsvc_a\t6\t\nsvc_c\t7\t\nsvc_d\t8\t\n", 9},
+		{RangeDrop, []string{"dropped", "dropped"}, "svc_b\t5\t\nsvc_c\t7\t\n", 6},
+	}
+
+	for _, mock := range mocks {
+
+		reg, _ := New(5, 10)
+		reg.SetRangePolicy(mock.policy)
+		if err := reg.Load(strings.NewReader(dump)); err != nil {
+			t.Fatal(err)
+		}
+
+		problems := reg.Problems()
+		if len(problems) != len(mock.actions) {
+			t.Fatalf("Policy %d: unexpected problems %v", mock.policy, problems)
+		}
+		for i, p := range problems {
+			if p.Fault != FaultRange || p.Action != mock.actions[i] {
+				t.Errorf("Policy %d: unexpected problem %v", mock.policy, p)
+			}
+		}
+
+		var buf bytes.Buffer
+		reg.Dump(&buf)
+		if buf.String() != mock.dumped {
+			t.Errorf("Policy %d: dumped %q instead of %q", mock.policy, buf.String(), mock.dumped)
+		}
+
+		if reg.portNext != mock.next {
+			t.Errorf("Policy %d: next port is %d instead of %d", mock.policy, reg.portNext, mock.next)
+		}
+
+		reg.Forget(1)
+		if reg.portNext != mock.next {
+			t.Errorf("Policy %d: forgetting a port below the range moved the next port", mock.policy)
+		}
+	}
+}
+
+func TestImport(t *testing.T) {
+
+	snapshot, problems, err := ParseDump(strings.NewReader("svc_2\t1\t\nsvc_x\t6\t\nbad line\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != 1 || problems[0].Fault != FaultMalformed || len(snapshot) != 2 {
+		t.Fatalf("Unexpected parsing result %v, %v", snapshot, problems)
+	}
+
+	reg := mockRegistry(t)
+
+	conflicts := reg.Import(append(snapshot, Entry{"svc_y", 2, nil}, Entry{"svc_z", 11, nil}), ImportMerge)
+	if len(conflicts) != 2 ||
+		conflicts[0].Fault != FaultDupPort || conflicts[0].Line != 3 ||
+		conflicts[1].Fault != FaultRange || conflicts[1].Line != 4 {
+		t.Errorf("Unexpected conflicts %v", conflicts)
+	}
+	if !reg.Equal(mockRegistry(t)) {
+		t.Error("A conflicting import should not change the registry")
+	}
+
+	if conflicts = reg.Import(snapshot, ImportMerge); conflicts != nil {
+		t.Fatalf("Unexpected conflicts %v", conflicts)
+	}
+	if err := matches(reg, "svc_x", 6); err != nil {
+		t.Error(err)
+	}
+	if list := reg.List(); len(list) != 6 || list[5].Name != "svc_x" {
+		t.Errorf("Unexpected merged list %v", list)
+	}
+
+	if conflicts = reg.Import(snapshot, ImportReplace); conflicts != nil {
+		t.Fatalf("Unexpected conflicts %v", conflicts)
+	}
+	expected := []Entry{{"svc_2", 1, nil}, {"svc_x", 6, nil}}
+	if list := reg.List(); !reflect.DeepEqual(list, expected) {
+		t.Errorf("Unexpected replaced list %v", list)
+	}
+	if reg.portNext != 2 {
+		t.Errorf("Next port is %d after replacing", reg.portNext)
+	}
+}
+
+func TestSetRange(t *testing.T) {
+
+	reg := mockRegistry(t)
+	reg.SetRangePolicy(RangeMigrate)
+	reg.SetLoadPolicy(LoadReject)
+
+	if _, err := reg.SetRange(3, 5); err == nil {
+		t.Error("Migrating 5 services into 3 ports should fail with the reject policy")
+	}
+	if !reg.Equal(mockRegistry(t)) {
+		t.Error("A failed range change should not change the registry")
+	}
+
+	reg.SetLoadPolicy(LoadOrphan)
+
+	problems, err := reg.SetRange(3, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != 2 || problems[0].Action != "orphaned" || problems[1].Action != "orphaned" {
+		t.Errorf("Unexpected problems %v", problems)
+	}
+	if list := reg.List(); len(list) != 3 || list[0].Port != 3 {
+		t.Errorf("Unexpected services %v", list)
+	}
+
+	reg.SetRangePolicy(RangeKeep)
+
+	if problems, err = reg.SetRange(1, 10); err != nil || len(problems) != 0 {
+		t.Errorf("Widening the range should revive the orphans, got %v, %v", problems, err)
+	}
+	if list := reg.List(); len(list) != 5 {
+		t.Errorf("Unexpected services %v", list)
+	}
+	if err := matches(reg, "svc_2", 1); err != nil {
+		t.Error(err)
+	}
+}
@@ -18,6 +18,7 @@ package registry
 
 import (
 	"fmt"
+	"strings"
 	"testing"
 )
 
@@ -212,3 +213,200 @@ func BenchmarkAddAlloc(b *testing.B) {
 
 	}
 }
+
+func TestUsage(t *testing.T) {
+
+	reg, _ := New(10, 12)
+	reg.Load(strings.NewReader("old\t5\t\n"))
+
+	if size, used := reg.Usage(); size != 3 || used != 0 {
+		t.Errorf("Unexpected usage %d of %d in an empty range", used, size)
+	}
+
+	for i := 0; i < 3; i++ {
+		reg.Alloc(fmt.Sprintf("svc_%d", i))
+	}
+
+	if size, used := reg.Usage(); size != 3 || used != 3 {
+		t.Errorf("Unexpected usage %d of %d in a full range", used, size)
+	}
+
+	if _, err := reg.Alloc("extra"); err != ErrNoPorts {
+		t.Errorf("Expected ErrNoPorts, got %v", err)
+	}
+}
+
+func TestNotify(t *testing.T) {
+
+	reg, _ := New(10, 12)
+	reg.SetRangePolicy(RangeMigrate)
+
+	var events []string
+	reg.Notify(func(ev Event) {
+		events = append(events, fmt.Sprintf("%s %s %d", ev.Kind, ev.Name, ev.Port))
+	})
+
+	reg.Alloc("a")
+	reg.Alloc("b")
+	reg.Forget(10)
+	reg.Forget(10)
+	reg.Import([]Entry{{"c", 12, nil}}, ImportMerge)
+	reg.SetRange(11, 13)
+	reg.SetRange(12, 13)
+
+	expected := []string{
+		"alloc a 10",
+		"alloc b 11",
+		"release a 10",
+		"alloc c 12",
+		"release b 11",
+		"alloc b 13",
+	}
+
+	if strings.Join(events, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Unexpected events:\n%s\ninstead of:\n%s", strings.Join(events, "\n"), strings.Join(expected, "\n"))
+	}
+
+	events = nil
+
+	for _, policy := range []RangePolicy{RangeMigrate, RangeDrop, RangeKeep} {
+		loaded, _ := New(10, 11)
+		loaded.SetRangePolicy(policy)
+		loaded.Notify(func(ev Event) {
+			events = append(events, fmt.Sprintf("%s %s %d", ev.Kind, ev.Name, ev.Port))
+		})
+		loaded.Load(strings.NewReader("a\t10\t\nb\t20\t\n"))
+	}
+
+	expected = []string{
+		"release b 20",
+		"alloc b 11",
+		"release b 20",
+	}
+
+	if strings.Join(events, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Unexpected load events:\n%s\ninstead of:\n%s", strings.Join(events, "\n"), strings.Join(expected, "\n"))
+	}
+}
+
+func TestReserve(t *testing.T) {
+
+	reg, _ := New(10, 13)
+
+	port, err := reg.Reserve("a")
+	if err != nil || port != 10 {
+		t.Fatalf("Reserve returned %d, %v", port, err)
+	}
+
+	if other, _ := reg.Reserve("b"); other != 11 {
+		t.Errorf("Reserve skipped no reserved port, returned %d", other)
+	}
+	if other, _ := reg.Alloc("c"); other != 12 {
+		t.Errorf("Alloc skipped no reserved port, returned %d", other)
+	}
+
+	reg.Unreserve(11)
+
+	if err = reg.AllocAt(port, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if err = reg.AllocAt(11, "a"); err == nil {
+		t.Error("Allocating a taken name should fail")
+	}
+	if err = reg.AllocAt(12, "d"); err == nil {
+		t.Error("Allocating a taken port should fail")
+	}
+	if err = reg.AllocAt(14, "d"); err == nil {
+		t.Error("Allocating out of the range should fail")
+	}
+	if _, err = reg.Reserve("a"); err == nil {
+		t.Error("Reserving for a taken name should fail")
+	}
+
+	if e, ok := reg.At(10); !ok || e.Name != "a" {
+		t.Errorf("At returned %v, %v", e, ok)
+	}
+	if port, _ = reg.Alloc("d"); port != 11 {
+		t.Errorf("Alloc after Unreserve returned %d", port)
+	}
+	if port, _ = reg.Alloc("e"); port != 13 {
+		t.Errorf("Alloc after AllocAt returned %d", port)
+	}
+}
+
+func TestStats(t *testing.T) {
+
+	reg, _ := New(10, 14)
+	reg.SetWatermarks([]int{80, 50})
+
+	var events []string
+	reg.Notify(func(ev Event) {
+		if wm := ev.Watermark; wm != nil {
+			events = append(events, fmt.Sprintf("%d %v %d/%d", wm.Percent, wm.Rising, wm.Used, wm.Size))
+		}
+	})
+
+	for _, name := range []string{"a", "b", "c", "d"} {
+		reg.Alloc(name)
+	}
+
+	if st := reg.Stats(); fmt.Sprint(st.Crossed) != "[50 80]" || st.Free != 1 {
+		t.Errorf("Unexpected stats at 80%%: %+v", st)
+	}
+
+	reg.Forget(11)
+	reg.Forget(12)
+
+	expected := "50 true 3/5, 80 true 4/5, 80 false 3/5, 50 false 2/5"
+	if got := strings.Join(events, ", "); got != expected {
+		t.Errorf("Watermark events %q instead of %q", got, expected)
+	}
+
+	st := reg.Stats()
+
+	if st.Size != 5 || st.Used != 2 || st.Free != 3 || len(st.Crossed) != 0 {
+		t.Errorf("Unexpected stats %+v", st)
+	}
+	if r := st.LargestFree; r == nil || *r != (Run{11, 12, 2}) {
+		t.Errorf("Unexpected largest free run %+v", r)
+	}
+	if o := st.Oldest; o == nil || o.Name != "a" || o.Since.IsZero() {
+		t.Errorf("Unexpected oldest allocation %+v", o)
+	}
+
+	reg.SetRange(10, 11)
+	if o := reg.Stats().Oldest; o == nil || !o.Since.Equal(st.Oldest.Since) {
+		t.Errorf("Changing the range lost the allocation time: %+v", o)
+	}
+
+	reg.Load(strings.NewReader("a\t10\t\n"))
+	if o := reg.Stats().Oldest; o != nil {
+		t.Errorf("The allocation time of a loaded service is unknown, got %+v", o)
+	}
+}
+
+func TestOrigin(t *testing.T) {
+
+	reg, _ := New(10, 12)
+
+	var events []string
+	reg.Notify(func(ev Event) {
+		events = append(events, fmt.Sprintf("%s %s %d %+v", ev.Kind, ev.Name, ev.Port, ev.Origin))
+	})
+
+	o := Origin{Caller: "192.0.2.1:1234", Client: "tester"}
+
+	reg.As(o).Alloc("a")
+	reg.As(o).Import([]Entry{{Name: "b", Port: 12}}, ImportMerge)
+	reg.Forget(10)
+
+	expected := []string{
+		"alloc a 10 {Caller:192.0.2.1:1234 Client:tester Import:false}",
+		"alloc b 12 {Caller:192.0.2.1:1234 Client:tester Import:true}",
+		"release a 10 {Caller: Client: Import:false}",
+	}
+
+	if strings.Join(events, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Unexpected events:\n%s\ninstead of:\n%s", strings.Join(events, "\n"), strings.Join(expected, "\n"))
+	}
+}
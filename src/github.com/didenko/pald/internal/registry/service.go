@@ -17,17 +17,21 @@
 package registry
 
 import (
-	"fmt"
 	"reflect"
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 )
 
 type service struct {
 	port uint16
 	name string
 	addr []string
+
+	// since is when the service got registered, zero for the
+	// services loaded from the storage, as it is not stored
+	since time.Time
 }
 
 func (s *service) equal(sr *service) bool {
@@ -57,12 +61,17 @@ func parseSvc(line string) (*service, error) {
 	// o:line, 1:name, 2:port, 3:addr, 4:comment
 	fields := reService.FindStringSubmatch(line)
 	if fields == nil {
-		return nil, fmt.Errorf("The line fails to match a service definition: %q", line)
+		return nil, faultf(FaultMalformed, "the line fails to match a service definition")
+	}
+
+	if fields[1] == "" {
+		// a blank or comment-only line
+		return nil, nil
 	}
 
 	port64, err := strconv.ParseUint(fields[2], 10, 16)
 	if err != nil {
-		return nil, fmt.Errorf("Port spec %q failes to parse into 16-bit unsigned integer: %s", fields[2], err.Error())
+		return nil, faultf(FaultMalformed, "port spec %q failes to parse into 16-bit unsigned integer", fields[2])
 	}
 
 	addr := compact(strings.Split(fields[3], ","))
@@ -71,8 +80,8 @@ func parseSvc(line string) (*service, error) {
 	}
 
 	return &service{
-		uint16(port64),
-		fields[1],
-		addr,
+		port: uint16(port64),
+		name: fields[1],
+		addr: addr,
 	}, nil
 }
@@ -0,0 +1,182 @@
+/*
+	(c) Copyright 2015 Vlad Didenko
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	    http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package registry
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// Entry is an exported copy of a registered service
+type Entry struct {
+	Name string   `json:"name"`
+	Port uint16   `json:"port"`
+	Addr []string `json:"addr,omitempty"`
+}
+
+func (e Entry) String() string {
+	return fmt.Sprintf("%s\t%d\t%s", e.Name, e.Port, strings.Join(e.Addr, ","))
+}
+
+// ImportMode defines how Import combines a snapshot with the registry
+type ImportMode int
+
+const (
+	// ImportMerge adds the snapshot services to the registered ones
+	ImportMerge ImportMode = iota
+
+	// ImportReplace forgets all registered services first
+	ImportReplace
+)
+
+// ParseImportMode converts the mode name into an ImportMode
+func ParseImportMode(name string) (ImportMode, error) {
+	switch name {
+	case "", "merge":
+		return ImportMerge, nil
+	case "replace":
+		return ImportReplace, nil
+	default:
+		return 0, fmt.Errorf("Unknown import mode %q", name)
+	}
+}
+
+// List returns all the registered services ordered by port
+func (r *Registry) List() []Entry {
+
+	r.RLock()
+	defer r.RUnlock()
+
+	list := make([]Entry, 0, len(r.byport))
+
+	var (
+		min uint16 = 0
+		max uint16 = ^uint16(0)
+	)
+
+	for p, next := min, min < max; next; p, next = p+1, p < max {
+		if s, ok := r.byport[p]; ok {
+			list = append(list, Entry{s.name, s.port, append([]string(nil), s.addr...)})
+		}
+	}
+
+	return list
+}
+
+// ParseDump reads a snapshot in the dump format. Malformed
+// lines are reported as problems.
+func ParseDump(rd io.Reader) ([]Entry, []Problem, error) {
+
+	var (
+		entries  []Entry
+		problems []Problem
+	)
+
+	scanner := bufio.NewScanner(rd)
+
+	for line := 1; scanner.Scan(); line++ {
+
+		svc, err := parseSvc(scanner.Text())
+		if err != nil {
+			problem := newProblem(line, scanner.Text(), err, nil)
+			problem.Action = "rejected"
+			problems = append(problems, problem)
+			continue
+		}
+		if svc != nil {
+			entries = append(entries, Entry{svc.name, svc.port, svc.addr})
+		}
+	}
+
+	return entries, problems, scanner.Err()
+}
+
+// Import registers the snapshot services all at once. If any of them
+// conflicts with the registry or with another one in the snapshot, or
+// falls outside of the port range, nothing is changed and the conflicts
+// are returned. A snapshot service identical to a registered one is not
+// a conflict. Problem lines refer to the snapshot entries, counting from 1.
+func (r *Registry) Import(snapshot []Entry, mode ImportMode) []Problem {
+	return r.importSnapshot(Origin{}, snapshot, mode)
+}
+
+func (r *Registry) importSnapshot(o Origin, snapshot []Entry, mode ImportMode) []Problem {
+
+	r.Lock()
+	defer r.Unlock()
+
+	staged := &Registry{
+		byname:  make(map[string]*service, len(snapshot)+len(r.byname)),
+		byport:  make(map[uint16]*service, len(snapshot)+len(r.byport)),
+		portMin: r.portMin,
+		portMax: r.portMax,
+	}
+
+	if mode == ImportMerge {
+		for port, svc := range r.byport {
+			staged.byport[port] = svc
+			staged.byname[svc.name] = svc
+		}
+	}
+
+	var conflicts []Problem
+
+	for i, e := range snapshot {
+
+		svc := &service{port: e.Port, name: e.Name, addr: e.Addr, since: time.Now()}
+		if len(svc.addr) == 0 {
+			svc.addr = nil
+		}
+		if old, ok := r.byname[svc.name]; ok && old.equal(svc) {
+			svc.since = old.since
+		}
+
+		if have, ok := staged.byname[svc.name]; ok && have.equal(svc) {
+			if _, registered := r.byname[svc.name]; registered {
+				continue
+			}
+		}
+
+		if err := staged.setSvc(svc, false); err != nil {
+			conflict := newProblem(i+1, e.String(), err, svc)
+			conflict.Action = "rejected"
+			conflicts = append(conflicts, conflict)
+		}
+	}
+
+	if len(conflicts) > 0 {
+		return conflicts
+	}
+
+	replaced := r.byname
+	r.byname = staged.byname
+	r.byport = staged.byport
+	if mode == ImportReplace {
+		r.orphans = nil
+	}
+	r.portNext = r.portMin
+	r.seekNext()
+
+	o.Import = true
+	r.emitDiff(replaced, o)
+	r.checkWatermarks()
+
+	return nil
+}
@@ -0,0 +1,179 @@
+/*
+	(c) Copyright 2015 Vlad Didenko
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	    http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package registry
+
+import (
+	"sort"
+	"time"
+)
+
+// Watermark is the utilization threshold crossed by a watermark event
+type Watermark struct {
+	Percent int  `json:"percent"`
+	Rising  bool `json:"rising"`
+	Used    int  `json:"used"`
+	Size    int  `json:"size"`
+}
+
+// Run is a range of consecutive ports
+type Run struct {
+	From   uint16 `json:"from"`
+	To     uint16 `json:"to"`
+	Length int    `json:"length"`
+}
+
+// Allocation is a registered service with the time it was registered
+type Allocation struct {
+	Entry
+	Since time.Time `json:"since"`
+}
+
+// Stats describe the utilization of the port range
+type Stats struct {
+	Size          int         `json:"size"`
+	Used          int         `json:"used"`
+	Free          int         `json:"free"`
+	Grandfathered int         `json:"grandfathered"`
+	Orphans       int         `json:"orphans"`
+	LargestFree   *Run        `json:"largest_free_run"`
+	Oldest        *Allocation `json:"oldest_allocation,omitempty"`
+	Watermarks    []int       `json:"watermarks"`
+	Crossed       []int       `json:"crossed"`
+}
+
+// SetWatermarks sets the utilization thresholds, in percent of the
+// range, which emit watermark events when crossed either way. The
+// thresholds crossed at the moment are taken silently.
+func (r *Registry) SetWatermarks(percents []int) {
+
+	r.Lock()
+	defer r.Unlock()
+
+	r.watermarks = append([]int(nil), percents...)
+	sort.Ints(r.watermarks)
+	r.crossed = r.level()
+}
+
+// level returns how many watermarks the utilization is at or above
+func (r *Registry) level() int {
+
+	size, used := r.usage()
+
+	n := 0
+	for _, wm := range r.watermarks {
+		if used*100 >= wm*size {
+			n++
+		}
+	}
+	return n
+}
+
+// checkWatermarks emits an event for every watermark crossed
+// since the last check, lowest first when rising
+func (r *Registry) checkWatermarks() {
+
+	level := r.level()
+	if level == r.crossed {
+		return
+	}
+
+	size, used := r.usage()
+
+	for r.crossed != level {
+
+		wm := Watermark{Used: used, Size: size}
+
+		if level > r.crossed {
+			wm.Percent = r.watermarks[r.crossed]
+			wm.Rising = true
+			r.crossed++
+		} else {
+			r.crossed--
+			wm.Percent = r.watermarks[r.crossed]
+		}
+
+		for _, fn := range r.hooks {
+			fn(Event{Kind: EventWatermark, Watermark: &wm})
+		}
+	}
+}
+
+// usage is Usage without locking
+func (r *Registry) usage() (size, used int) {
+
+	for p := range r.byport {
+		if p >= r.portMin && p <= r.portMax {
+			used++
+		}
+	}
+
+	return int(r.portMax) - int(r.portMin) + 1, used
+}
+
+// Stats returns the current utilization of the range
+func (r *Registry) Stats() Stats {
+
+	r.RLock()
+	defer r.RUnlock()
+
+	st := Stats{
+		Orphans:    len(r.orphans),
+		Watermarks: append([]int{}, r.watermarks...),
+		Crossed:    append([]int{}, r.watermarks[:r.crossed]...),
+	}
+
+	st.Size, st.Used = r.usage()
+	st.Free = st.Size - st.Used
+	st.Grandfathered = len(r.byport) - st.Used
+
+	var run Run
+
+	for p, next := r.portMin, r.portMin <= r.portMax; next; p, next = p+1, p < r.portMax {
+
+		if _, taken := r.byport[p]; taken {
+			run.Length = 0
+			continue
+		}
+
+		if run.Length == 0 {
+			run.From = p
+		}
+		run.To = p
+		run.Length++
+
+		if st.LargestFree == nil || run.Length > st.LargestFree.Length {
+			largest := run
+			st.LargestFree = &largest
+		}
+	}
+
+	for _, svc := range r.byport {
+		if svc.since.IsZero() {
+			continue
+		}
+		if st.Oldest == nil || svc.since.Before(st.Oldest.Since) ||
+			svc.since.Equal(st.Oldest.Since) && svc.port < st.Oldest.Port {
+
+			st.Oldest = &Allocation{
+				Entry{svc.name, svc.port, append([]string(nil), svc.addr...)},
+				svc.since,
+			}
+		}
+	}
+
+	return st
+}
@@ -0,0 +1,274 @@
+/*
+	(c) Copyright 2015 Vlad Didenko
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	    http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+// Package rpc serves gRPC over HTTP/2 without TLS. The messages are
+// encoded by hand in the protobuf wire format, so the services need
+// no generated code, while any gRPC client can call them.
+package rpc
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// maxMessage limits the size of a request message
+const maxMessage = 4 << 20
+
+// Code is a gRPC status code
+type Code uint32
+
+// The status codes in use
+const (
+	OK                Code = 0
+	Canceled          Code = 1
+	Unknown           Code = 2
+	InvalidArgument   Code = 3
+	DeadlineExceeded  Code = 4
+	NotFound          Code = 5
+	AlreadyExists     Code = 6
+	PermissionDenied  Code = 7
+	ResourceExhausted Code = 8
+	Aborted           Code = 10
+	Unimplemented     Code = 12
+	Internal          Code = 13
+	Unavailable       Code = 14
+)
+
+// Status is a failed call
+type Status struct {
+	Code    Code
+	Message string
+}
+
+func (s *Status) Error() string {
+	return fmt.Sprintf("%s (gRPC code %d)", s.Message, s.Code)
+}
+
+// Errorf returns a *Status error with the code
+func Errorf(code Code, format string, a ...interface{}) error {
+	return &Status{code, fmt.Sprintf(format, a...)}
+}
+
+// Unary serves a call with a single response message
+type Unary func(r *http.Request, req []byte) (Message, error)
+
+// Stream serves a call streaming the response messages
+// by send until it returns
+type Stream func(r *http.Request, req []byte, send func(Message) error) error
+
+// Mux routes the calls by the method paths, like /package.Service/Method.
+// Both the unary and the server streaming methods take a single request
+// message. The errors other than *Status are returned as Unknown.
+type Mux struct {
+	unary  map[string]Unary
+	stream map[string]Stream
+}
+
+// NewMux returns a Mux without methods
+func NewMux() *Mux {
+	return &Mux{
+		unary:  make(map[string]Unary),
+		stream: make(map[string]Stream),
+	}
+}
+
+// Unary registers a unary method
+func (m *Mux) Unary(method string, h Unary) {
+	m.unary[method] = h
+}
+
+// Stream registers a server streaming method
+func (m *Mux) Stream(method string, h Stream) {
+	m.stream[method] = h
+}
+
+func (m *Mux) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	ct := r.Header.Get("Content-Type")
+	if r.Method != "POST" || r.ProtoMajor != 2 ||
+		(ct != "application/grpc" && ct != "application/grpc+proto") {
+		http.Error(w, "Only gRPC calls are served", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	if timeout, ok := parseTimeout(r.Header.Get("Grpc-Timeout")); ok {
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		r = r.WithContext(ctx)
+	}
+
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+	w.WriteHeader(http.StatusOK)
+
+	send := func(msg Message) error {
+		frame := make([]byte, 5, 5+len(msg))
+		binary.BigEndian.PutUint32(frame[1:], uint32(len(msg)))
+		if _, err := w.Write(append(frame, msg...)); err != nil {
+			return err
+		}
+		w.(http.Flusher).Flush()
+		return nil
+	}
+
+	err := m.call(r, send)
+
+	status, ok := err.(*Status)
+	switch {
+	case err == nil:
+		status = &Status{OK, ""}
+	case r.Context().Err() == context.DeadlineExceeded:
+		status = &Status{DeadlineExceeded, "Deadline exceeded"}
+	case !ok:
+		status = &Status{Unknown, err.Error()}
+	}
+
+	w.Header().Set("Grpc-Status", strconv.Itoa(int(status.Code)))
+	if status.Message != "" {
+		w.Header().Set("Grpc-Message", encodeMessage(status.Message))
+	}
+}
+
+// call reads the request and runs the method
+func (m *Mux) call(r *http.Request, send func(Message) error) error {
+
+	unary, isUnary := m.unary[r.URL.Path]
+	stream, isStream := m.stream[r.URL.Path]
+	if !isUnary && !isStream {
+		return Errorf(Unimplemented, "Method %s is not implemented", r.URL.Path)
+	}
+
+	req, err := readMessage(r.Body)
+	if err != nil {
+		return err
+	}
+
+	if isStream {
+		return stream(r, req, send)
+	}
+
+	resp, err := unary(r, req)
+	if err != nil {
+		return err
+	}
+
+	return send(resp)
+}
+
+// readMessage reads the single request message
+func readMessage(body io.Reader) ([]byte, error) {
+
+	var head [5]byte
+	if _, err := io.ReadFull(body, head[:]); err != nil {
+		return nil, Errorf(InvalidArgument, "Failed to read the request: %s", err)
+	}
+
+	if head[0] != 0 {
+		return nil, Errorf(Unimplemented, "Compressed messages are not supported")
+	}
+
+	size := binary.BigEndian.Uint32(head[1:])
+	if size > maxMessage {
+		return nil, Errorf(ResourceExhausted, "Request of %d bytes is too large", size)
+	}
+
+	msg := make([]byte, size)
+	if _, err := io.ReadFull(body, msg); err != nil {
+		return nil, Errorf(InvalidArgument, "Failed to read the request: %s", err)
+	}
+
+	return msg, nil
+}
+
+// parseTimeout parses the grpc-timeout header, like 100m or 5S
+func parseTimeout(value string) (time.Duration, bool) {
+
+	if len(value) < 2 || len(value) > 9 {
+		return 0, false
+	}
+
+	n, err := strconv.ParseInt(value[:len(value)-1], 10, 64)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+
+	unit, ok := map[byte]time.Duration{
+		'H': time.Hour,
+		'M': time.Minute,
+		'S': time.Second,
+		'm': time.Millisecond,
+		'u': time.Microsecond,
+		'n': time.Nanosecond,
+	}[value[len(value)-1]]
+
+	return time.Duration(n) * unit, ok
+}
+
+// encodeMessage percent-encodes the status message as gRPC requires
+func encodeMessage(msg string) string {
+
+	var sb strings.Builder
+
+	for _, b := range []byte(msg) {
+		if b < ' ' || b > '~' || b == '%' {
+			fmt.Fprintf(&sb, "%%%02X", b)
+		} else {
+			sb.WriteByte(b)
+		}
+	}
+
+	return sb.String()
+}
+
+// Listen listens at a unix:/path socket, replacing a stale one,
+// or at a TCP host:port address or just a port number
+func Listen(addr string) (net.Listener, error) {
+
+	if path, ok := strings.CutPrefix(addr, "unix:"); ok {
+		if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+			if c, err := net.Dial("unix", path); err == nil {
+				c.Close()
+				return nil, fmt.Errorf("Socket %s is in use", path)
+			}
+			os.Remove(path)
+		}
+		return net.Listen("unix", path)
+	}
+
+	if strings.IndexFunc(addr, func(r rune) bool { return !unicode.IsDigit(r) }) < 0 {
+		addr = ":" + addr
+	}
+
+	return net.Listen("tcp", addr)
+}
+
+// NewServer returns an HTTP server speaking HTTP/2 without TLS only
+func NewServer(h http.Handler) *http.Server {
+
+	srv := &http.Server{Handler: h, Protocols: new(http.Protocols)}
+	srv.Protocols.SetUnencryptedHTTP2(true)
+
+	return srv
+}
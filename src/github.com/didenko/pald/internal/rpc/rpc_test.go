@@ -0,0 +1,120 @@
+/*
+	(c) Copyright 2015 Vlad Didenko
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	    http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package rpc
+
+import (
+	"bytes"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestWire(t *testing.T) {
+
+	var sub Message
+	sub.String(1, "web")
+
+	var m Message
+	m.Uint(1, 300)
+	m.Uint(2, 0)
+	m.Bool(3, true)
+	m.String(4, "")
+	m.Strings(5, []string{"a", ""})
+	m.Embed(6, sub)
+	m.Embed(7, nil)
+
+	// A fixed64 and a fixed32 field from a newer peer
+	m = append(m, 8<<3|1, 1, 2, 3, 4, 5, 6, 7, 8, 9<<3|5, 1, 2, 3, 4)
+
+	var got []Field
+	if err := Decode(m, func(f Field) { got = append(got, f) }); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []Field{
+		{Number: 1, Value: 300},
+		{Number: 3, Value: 1},
+		{Number: 5, Bytes: []byte("a")},
+		{Number: 5, Bytes: []byte{}},
+		{Number: 6, Bytes: sub},
+		{Number: 7, Bytes: []byte{}},
+		{Number: 8, Value: 0x0807060504030201},
+		{Number: 9, Value: 0x04030201},
+	}
+
+	if len(got) != len(want) {
+		t.Fatalf("Decoded %v instead of %v", got, want)
+	}
+	for i := range want {
+		if got[i].Number != want[i].Number || got[i].Value != want[i].Value || !bytes.Equal(got[i].Bytes, want[i].Bytes) {
+			t.Errorf("Decoded field %v instead of %v", got[i], want[i])
+		}
+	}
+
+	for _, bad := range [][]byte{{0x08}, {0x12, 5, 'a'}, {0x0b}, {0x00, 1}} {
+		if err := Decode(bad, func(Field) {}); err == nil {
+			t.Errorf("Decoding malformed %x should fail", bad)
+		}
+	}
+}
+
+func TestParseTimeout(t *testing.T) {
+	for value, want := range map[string]time.Duration{
+		"5S":   5 * time.Second,
+		"100m": 100 * time.Millisecond,
+		"1H":   time.Hour,
+		"7":    0,
+		"5s":   0,
+		"-1S":  0,
+	} {
+		got, ok := parseTimeout(value)
+		if got != want || ok != (want != 0) {
+			t.Errorf("Timeout %q parsed as %v, %v", value, got, ok)
+		}
+	}
+}
+
+func TestEncodeMessage(t *testing.T) {
+	if got := encodeMessage("Name \"ü\" 100%\n"); got != "Name \"%C3%BC\" 100%25%0A" {
+		t.Errorf("Unexpected encoding %q", got)
+	}
+}
+
+func TestListenUnix(t *testing.T) {
+
+	name := "./listen.test"
+	defer os.Remove(name)
+
+	ln, err := Listen("unix:" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = Listen("unix:" + name); err == nil {
+		t.Error("Listening at a socket in use should fail")
+	}
+
+	// Leave a stale socket behind
+	ln.(interface{ SetUnlinkOnClose(bool) }).SetUnlinkOnClose(false)
+	ln.Close()
+
+	ln, err = Listen("unix:" + name)
+	if err != nil {
+		t.Fatal("Failed to replace a stale socket:", err)
+	}
+	ln.Close()
+}
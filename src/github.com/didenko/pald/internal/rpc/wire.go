@@ -0,0 +1,139 @@
+/*
+	(c) Copyright 2015 Vlad Didenko
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	    http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package rpc
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+// Protobuf wire types
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+var errMalformed = errors.New("Malformed protobuf message")
+
+// Message is a protobuf message being encoded. Following proto3,
+// the fields with zero values are omitted.
+type Message []byte
+
+func (m *Message) tag(field, wire int) {
+	*m = binary.AppendUvarint(*m, uint64(field)<<3|uint64(wire))
+}
+
+// Uint appends a varint field, e.g. uint32, uint64 or int64
+func (m *Message) Uint(field int, v uint64) {
+	if v == 0 {
+		return
+	}
+	m.tag(field, wireVarint)
+	*m = binary.AppendUvarint(*m, v)
+}
+
+// Bool appends a bool field
+func (m *Message) Bool(field int, v bool) {
+	if v {
+		m.Uint(field, 1)
+	}
+}
+
+// String appends a string field
+func (m *Message) String(field int, s string) {
+	if s == "" {
+		return
+	}
+	m.tag(field, wireBytes)
+	*m = binary.AppendUvarint(*m, uint64(len(s)))
+	*m = append(*m, s...)
+}
+
+// Strings appends a repeated string field, keeping the empty strings
+func (m *Message) Strings(field int, ss []string) {
+	for _, s := range ss {
+		m.tag(field, wireBytes)
+		*m = binary.AppendUvarint(*m, uint64(len(s)))
+		*m = append(*m, s...)
+	}
+}
+
+// Embed appends a message field. Unlike the scalar fields,
+// an empty message is kept, as it differs from a missing one.
+func (m *Message) Embed(field int, sub Message) {
+	m.tag(field, wireBytes)
+	*m = binary.AppendUvarint(*m, uint64(len(sub)))
+	*m = append(*m, sub...)
+}
+
+// Field is a decoded field. Value holds the varint and fixed
+// width values, Bytes the strings, bytes and embedded messages.
+type Field struct {
+	Number int
+	Value  uint64
+	Bytes  []byte
+}
+
+// Decode calls fn with every field of the message in order
+func Decode(data []byte, fn func(Field)) error {
+
+	for len(data) > 0 {
+
+		tag, n := binary.Uvarint(data)
+		if n <= 0 || tag>>3 == 0 || tag>>3 > math.MaxInt32 {
+			return errMalformed
+		}
+		data = data[n:]
+
+		f := Field{Number: int(tag >> 3)}
+
+		switch tag & 7 {
+		case wireVarint:
+			f.Value, n = binary.Uvarint(data)
+			if n <= 0 {
+				return errMalformed
+			}
+		case wireFixed64:
+			if n = 8; len(data) < n {
+				return errMalformed
+			}
+			f.Value = binary.LittleEndian.Uint64(data)
+		case wireFixed32:
+			if n = 4; len(data) < n {
+				return errMalformed
+			}
+			f.Value = uint64(binary.LittleEndian.Uint32(data))
+		case wireBytes:
+			size, m := binary.Uvarint(data)
+			if m <= 0 || size > uint64(len(data)-m) {
+				return errMalformed
+			}
+			n = m + int(size)
+			f.Bytes = data[m:n]
+		default:
+			return errMalformed
+		}
+
+		data = data[n:]
+		fn(f)
+	}
+
+	return nil
+}
@@ -0,0 +1,80 @@
+/*
+	(c) Copyright 2015 Vlad Didenko
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	    http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package server
+
+import (
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// recorder keeps the response details for the access log
+type recorder struct {
+	http.ResponseWriter
+	status int
+	port   uint16
+}
+
+func (rec *recorder) WriteHeader(status int) {
+	rec.status = status
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+// notePort records the port a request resulted in for the access log
+func notePort(w http.ResponseWriter, port uint16) {
+	if rec, ok := w.(*recorder); ok {
+		rec.port = port
+	}
+}
+
+// instrument records the latency of the handler under the name
+// and, if enabled, writes an access log record per request
+func instrument(name string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		rec := &recorder{ResponseWriter: w, status: http.StatusOK}
+		start := time.Now()
+
+		handler(rec, r)
+
+		latency := time.Since(start)
+		mRequests.Observe(latency.Seconds(), name)
+
+		reloading.RLock()
+		enabled := current.AccessLog
+		reloading.RUnlock()
+
+		if !enabled {
+			return
+		}
+
+		attrs := []interface{}{
+			"handler", name,
+			"remote", r.RemoteAddr,
+			"status", rec.status,
+			"latency", latency,
+		}
+		if service := r.Form.Get("service"); service != "" {
+			attrs = append(attrs, "service", service)
+		}
+		if rec.port != 0 {
+			attrs = append(attrs, "port", rec.port)
+		}
+
+		slog.Info("access", attrs...)
+	}
+}
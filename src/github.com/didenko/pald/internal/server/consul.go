@@ -0,0 +1,292 @@
+/*
+	(c) Copyright 2015 Vlad Didenko
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	    http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package server
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// consulWait and consulMaxWait are the default and the longest
+	// time a blocking Consul query waits for a change
+	consulWait    = 5 * time.Minute
+	consulMaxWait = 10 * time.Minute
+
+	// consulDatacenter is the datacenter the services appear in
+	consulDatacenter = "dc1"
+)
+
+// consulNode is the node the services appear to run on
+var consulNode = func() string {
+	if name, err := os.Hostname(); err == nil && name != "" {
+		return name
+	}
+	return "pald"
+}()
+
+// consulService is an entry of /v1/catalog/service/<name>
+type consulService struct {
+	ID                       string
+	Node                     string
+	Address                  string
+	Datacenter               string
+	TaggedAddresses          map[string]string
+	NodeMeta                 map[string]string
+	ServiceID                string
+	ServiceName              string
+	ServiceTags              []string
+	ServiceAddress           string
+	ServicePort              uint16
+	ServiceMeta              map[string]string
+	ServiceEnableTagOverride bool
+	CreateIndex              uint64
+	ModifyIndex              uint64
+}
+
+// consulHealth is an entry of /v1/health/service/<name>
+type consulHealth struct {
+	Node struct {
+		ID         string
+		Node       string
+		Address    string
+		Datacenter string
+		Meta       map[string]string
+	}
+	Service struct {
+		ID                string
+		Service           string
+		Tags              []string
+		Address           string
+		Port              uint16
+		Meta              map[string]string
+		EnableTagOverride bool
+	}
+	Checks []consulCheck
+}
+
+type consulCheck struct {
+	Node        string
+	CheckID     string
+	Name        string
+	Status      string
+	Notes       string
+	Output      string
+	ServiceID   string
+	ServiceName string
+	ServiceTags []string
+}
+
+// consulInstrument instruments a Consul handler, but observes the
+// blocking queries under the handler name with _blocking appended,
+// as they last up to the wait time by design
+func consulInstrument(name string, handler http.HandlerFunc) http.HandlerFunc {
+
+	plain := instrument(name, handler)
+	blocking := instrument(name+"_blocking", handler)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("index") != "" {
+			blocking(w, r)
+			return
+		}
+		plain(w, r)
+	}
+}
+
+// consulBlock waits for a registry change if the request is a
+// blocking query, and returns the Consul index to answer with.
+// A blocking query gives the index of the previous answer, and
+// optionally the wait time, and returns once there is a change or
+// the time is up. The index is the number of the registry changes
+// since the start, plus one, as Consul indexes are never zero.
+func consulBlock(w http.ResponseWriter, r *http.Request) (uint64, bool) {
+
+	seq, wake := changes()
+
+	if s := r.Form.Get("index"); s != "" {
+
+		index, err := strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			http.Error(w, "The index parameter is not a number", http.StatusBadRequest)
+			return 0, false
+		}
+
+		wait := consulWait
+		if s := r.Form.Get("wait"); s != "" {
+			if wait, err = time.ParseDuration(s); err != nil {
+				http.Error(w, "The wait parameter is not a duration", http.StatusBadRequest)
+				return 0, false
+			}
+		}
+		if wait > consulMaxWait {
+			wait = consulMaxWait
+		}
+
+		if index == seq+1 {
+			timer := time.NewTimer(wait)
+			defer timer.Stop()
+
+			select {
+			case <-wake:
+				seq, _ = changes()
+			case <-timer.C:
+			case <-r.Context().Done():
+			}
+		}
+	}
+
+	return seq + 1, true
+}
+
+// consulReply writes the JSON body with the Consul headers
+func consulReply(w http.ResponseWriter, index uint64, body interface{}) {
+
+	cacheOff(w)
+
+	w.Header().Set("X-Consul-Index", strconv.FormatUint(index, 10))
+	w.Header().Set("X-Consul-KnownLeader", "true")
+	w.Header().Set("X-Consul-LastContact", "0")
+	w.Header().Add("Content-Type", "application/json")
+
+	json.NewEncoder(w).Encode(body)
+}
+
+// consulAddress returns the host of the first service
+// address, or an empty string, meaning the node address
+func consulAddress(addr []string) string {
+
+	if len(addr) == 0 {
+		return ""
+	}
+
+	if host, _, err := net.SplitHostPort(addr[0]); err == nil {
+		return host
+	}
+
+	return addr[0]
+}
+
+// consulServices serves /v1/catalog/services, the names of all
+// the services, none of which have tags
+func consulServices(w http.ResponseWriter, r *http.Request) {
+
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	index, ok := consulBlock(w, r)
+	if !ok {
+		return
+	}
+
+	services := make(map[string][]string)
+	for _, e := range reg.List() {
+		services[e.Name] = []string{}
+	}
+
+	consulReply(w, index, services)
+}
+
+// consulCatalog serves /v1/catalog/service/<name>, the
+// service instance, if the service is registered
+func consulCatalog(w http.ResponseWriter, r *http.Request) {
+
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	index, ok := consulBlock(w, r)
+	if !ok {
+		return
+	}
+
+	name := strings.TrimPrefix(r.URL.Path, "/v1/catalog/service/")
+
+	instances := []consulService{}
+
+	if port, addr, err := reg.Lookup(name); err == nil {
+		instances = append(instances, consulService{
+			Node:           consulNode,
+			Address:        "127.0.0.1",
+			Datacenter:     consulDatacenter,
+			ServiceID:      name,
+			ServiceName:    name,
+			ServiceTags:    []string{},
+			ServiceAddress: consulAddress(addr),
+			ServicePort:    port,
+			CreateIndex:    index,
+			ModifyIndex:    index,
+		})
+	}
+
+	consulReply(w, index, instances)
+}
+
+// consulHealthService serves /v1/health/service/<name>, the
+// service instance, if the service is registered, always passing
+// its health check, as pald does not check the services
+func consulHealthService(w http.ResponseWriter, r *http.Request) {
+
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	index, ok := consulBlock(w, r)
+	if !ok {
+		return
+	}
+
+	name := strings.TrimPrefix(r.URL.Path, "/v1/health/service/")
+
+	instances := []consulHealth{}
+
+	if port, addr, err := reg.Lookup(name); err == nil {
+
+		var h consulHealth
+
+		h.Node.Node = consulNode
+		h.Node.Address = "127.0.0.1"
+		h.Node.Datacenter = consulDatacenter
+
+		h.Service.ID = name
+		h.Service.Service = name
+		h.Service.Tags = []string{}
+		h.Service.Address = consulAddress(addr)
+		h.Service.Port = port
+
+		h.Checks = []consulCheck{{
+			Node:        consulNode,
+			CheckID:     "serfHealth",
+			Name:        "Serf Health Status",
+			Status:      "passing",
+			ServiceTags: []string{},
+		}}
+
+		instances = append(instances, h)
+	}
+
+	consulReply(w, index, instances)
+}
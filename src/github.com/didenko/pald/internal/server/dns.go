@@ -0,0 +1,97 @@
+/*
+	(c) Copyright 2015 Vlad Didenko
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	    http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package server
+
+import (
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/didenko/pald/internal/dns"
+)
+
+var (
+	responder = dns.New("pald", 5, dnsLookup)
+	dnsSrv    *dns.Server
+)
+
+// dnsLookup finds the service for the DNS responder. The names
+// differing from the query only in case match, as DNS names do.
+func dnsLookup(name string) (uint16, []string, bool, error) {
+
+	if err := loaded(); err != nil {
+		return 0, nil, false, err
+	}
+
+	if port, addr, err := reg.Lookup(name); err == nil {
+		return port, addr, true, nil
+	}
+
+	for _, e := range reg.List() {
+		if strings.EqualFold(e.Name, name) {
+			return e.Port, e.Addr, true, nil
+		}
+	}
+
+	return 0, nil, false, nil
+}
+
+// serveDNS starts the DNS responder at the address, unless it is
+// empty, and then stops the previous listener, if any
+func serveDNS(addr string) error {
+
+	var srv *dns.Server
+
+	if addr != "" {
+		var err error
+		if srv, err = dns.Listen(addr, responder); err != nil {
+			return err
+		}
+	}
+
+	old := dnsSrv
+	dnsSrv = srv
+
+	if old != nil {
+		old.Close()
+	}
+
+	return nil
+}
+
+// configureDNS applies the zone and the TTL to the responder
+func configureDNS(zone string, ttl time.Duration) {
+	responder.Configure(zone, uint32(ttl/time.Second))
+}
+
+// relistenDNS applies a changed DNS listener address
+func relistenDNS(cfg Config) error {
+
+	if cfg.DNSListen == current.DNSListen {
+		return nil
+	}
+
+	if err := serveDNS(cfg.DNSListen); err != nil {
+		slog.Error("Reload failed to listen for DNS", "dns_listen", cfg.DNSListen, "err", err)
+		return err
+	}
+
+	slog.Info("Reload changed the DNS listener", "dns_listen", cfg.DNSListen)
+	current.DNSListen = cfg.DNSListen
+
+	return nil
+}
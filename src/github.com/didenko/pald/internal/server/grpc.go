@@ -0,0 +1,286 @@
+/*
+	(c) Copyright 2015 Vlad Didenko
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	    http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package server
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/didenko/pald/internal/rpc"
+)
+
+// grpcService prefixes the method paths of the
+// pald.Registry service, defined in pald.proto
+const grpcService = "/pald.Registry/"
+
+var (
+	grpcMux = rpc.NewMux()
+	grpcSrv *http.Server
+)
+
+func init() {
+	grpcMux.Unary(grpcService+"Lookup", grpcUnary("lookup", grpcLookup))
+	grpcMux.Unary(grpcService+"Alloc", grpcUnary("alloc", grpcAlloc))
+	grpcMux.Unary(grpcService+"Forget", grpcUnary("forget", grpcForget))
+	grpcMux.Unary(grpcService+"List", grpcUnary("list", grpcList))
+	grpcMux.Stream(grpcService+"Watch", grpcWatch)
+}
+
+// serveGRPC starts serving gRPC at the address, unless it is
+// empty, and then gracefully stops the previous listener, if any
+func serveGRPC(addr string) error {
+
+	var srv *http.Server
+
+	if addr != "" {
+
+		ln, err := rpc.Listen(addr)
+		if err != nil {
+			return err
+		}
+
+		srv = rpc.NewServer(grpcMux)
+
+		go func() {
+			if err := srv.Serve(ln); err != http.ErrServerClosed {
+				fatal <- err
+			}
+		}()
+	}
+
+	old := grpcSrv
+	grpcSrv = srv
+
+	if old != nil {
+		go stop(old)
+	}
+
+	return nil
+}
+
+// grpcUnary makes the method unavailable while the registry
+// is not loaded and records its latency under the name
+func grpcUnary(name string, method rpc.Unary) rpc.Unary {
+	return func(r *http.Request, req []byte) (rpc.Message, error) {
+
+		start := time.Now()
+		defer func() {
+			mRequests.Observe(time.Since(start).Seconds(), "grpc_"+name)
+		}()
+
+		if err := loaded(); err != nil {
+			return nil, rpc.Errorf(rpc.Unavailable, "The registry is not loaded: %s", err)
+		}
+
+		return method(r, req)
+	}
+}
+
+// decode reads the string and the integer fields of the request
+func decode(req []byte) (map[int]string, map[int]uint64, error) {
+
+	strs := make(map[int]string)
+	ints := make(map[int]uint64)
+
+	err := rpc.Decode(req, func(f rpc.Field) {
+		if f.Bytes != nil {
+			strs[f.Number] = string(f.Bytes)
+		} else {
+			ints[f.Number] = f.Value
+		}
+	})
+	if err != nil {
+		return nil, nil, rpc.Errorf(rpc.InvalidArgument, "%s", err)
+	}
+
+	return strs, ints, nil
+}
+
+// serviceName returns the name field of the request
+func serviceName(req []byte) (string, error) {
+
+	strs, _, err := decode(req)
+	if err != nil {
+		return "", err
+	}
+
+	if strs[1] == "" {
+		return "", rpc.Errorf(rpc.InvalidArgument, "Service name is missing")
+	}
+
+	return strs[1], nil
+}
+
+// serviceMessage encodes a pald.Service
+func serviceMessage(name string, port uint16, addr []string) rpc.Message {
+	var m rpc.Message
+	m.String(1, name)
+	m.Uint(2, uint64(port))
+	m.Strings(3, addr)
+	return m
+}
+
+func grpcLookup(r *http.Request, req []byte) (rpc.Message, error) {
+
+	name, err := serviceName(req)
+	if err != nil {
+		return nil, err
+	}
+
+	port, addr, err := reg.Lookup(name)
+	if err != nil {
+		return nil, rpc.Errorf(rpc.NotFound, "%s", err)
+	}
+
+	return serviceMessage(name, port, addr), nil
+}
+
+func grpcAlloc(r *http.Request, req []byte) (rpc.Message, error) {
+
+	name, err := serviceName(req)
+	if err != nil {
+		return nil, err
+	}
+
+	port, err := register(origin(r), name)
+	if err != nil {
+		code := map[string]rpc.Code{
+			"vetoed":     rpc.PermissionDenied,
+			"exhausted":  rpc.ResourceExhausted,
+			"name_taken": rpc.AlreadyExists,
+			"port_taken": rpc.Aborted,
+			"other":      rpc.Internal,
+		}[failure(err)]
+		return nil, rpc.Errorf(code, "%s", err)
+	}
+
+	return serviceMessage(name, port, nil), nil
+}
+
+func grpcForget(r *http.Request, req []byte) (rpc.Message, error) {
+
+	_, ints, err := decode(req)
+	if err != nil {
+		return nil, err
+	}
+
+	port := ints[1]
+	if port == 0 || port > 65535 {
+		return nil, rpc.Errorf(rpc.InvalidArgument, "Port number %d is out of range", port)
+	}
+
+	var m rpc.Message
+	if service, ok := release(origin(r), uint16(port)); ok {
+		m.String(1, service)
+	}
+
+	return m, nil
+}
+
+func grpcList(r *http.Request, req []byte) (rpc.Message, error) {
+
+	var m rpc.Message
+	for _, e := range reg.List() {
+		m.Embed(1, serviceMessage(e.Name, e.Port, e.Addr))
+	}
+
+	return m, nil
+}
+
+// grpcWatch streams the registry changes with the same
+// semantics as the /watch endpoint
+func grpcWatch(r *http.Request, req []byte, send func(rpc.Message) error) error {
+
+	strs, _, err := decode(req)
+	if err != nil {
+		return err
+	}
+
+	token, name, prefix := strs[1], strs[2], strs[3]
+	if token == "" {
+		token = latest()
+	}
+
+	pending, wake, err := since(token)
+
+	for {
+		if err != nil {
+			token = latest()
+			pending, wake, _ = since(token)
+
+			var m rpc.Message
+			m.String(1, token)
+			m.String(2, "reset")
+			m.Embed(5, timestamp(time.Now()))
+			m.String(6, err.Error())
+			if err = send(m); err != nil {
+				return err
+			}
+		}
+
+		for _, ev := range pending {
+			token = ev.ID
+			if !ev.matches(name, prefix) {
+				continue
+			}
+			if err = send(eventMessage(ev)); err != nil {
+				return err
+			}
+		}
+
+		select {
+		case <-r.Context().Done():
+			return r.Context().Err()
+		case <-wake:
+		}
+
+		pending, wake, err = since(token)
+	}
+}
+
+// eventMessage encodes a pald.Event
+func eventMessage(ev Event) rpc.Message {
+
+	var m rpc.Message
+	m.String(1, ev.ID)
+	m.String(2, ev.Type)
+
+	if ev.Service != "" {
+		m.Embed(3, serviceMessage(ev.Service, ev.Port, ev.Addr))
+	}
+
+	if wm := ev.Watermark; wm != nil {
+		var w rpc.Message
+		w.Uint(1, uint64(wm.Percent))
+		w.Bool(2, wm.Rising)
+		w.Uint(3, uint64(wm.Used))
+		w.Uint(4, uint64(wm.Size))
+		m.Embed(4, w)
+	}
+
+	m.Embed(5, timestamp(ev.Time))
+
+	return m
+}
+
+// timestamp encodes a google.protobuf.Timestamp
+func timestamp(t time.Time) rpc.Message {
+	var m rpc.Message
+	m.Uint(1, uint64(t.Unix()))
+	m.Uint(2, uint64(t.Nanosecond()))
+	return m
+}
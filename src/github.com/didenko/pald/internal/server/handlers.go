@@ -17,11 +17,23 @@
 package server
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
+	"log/slog"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
+
+	"github.com/didenko/pald/internal/audit"
+	"github.com/didenko/pald/internal/hook"
+	"github.com/didenko/pald/internal/registry"
 )
 
+// daemonClient is the client of the changes the daemon makes itself
+const daemonClient = "pald"
+
 func cacheOff(w http.ResponseWriter) {
 	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
 	w.Header().Set("Pragma", "no-cache")
@@ -32,7 +44,7 @@ func get(w http.ResponseWriter, r *http.Request) {
 
 	cacheOff(w)
 
-	err = r.ParseForm()
+	err := r.ParseForm()
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
@@ -52,6 +64,8 @@ func get(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	notePort(w, port)
+
 	w.Header().Add("Content-Type", "text/plain")
 	fmt.Fprintf(w, "%d\n", port)
 }
@@ -60,7 +74,7 @@ func set(w http.ResponseWriter, r *http.Request) {
 
 	cacheOff(w)
 
-	err = r.ParseForm()
+	err := r.ParseForm()
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
@@ -69,17 +83,22 @@ func set(w http.ResponseWriter, r *http.Request) {
 	service := r.Form.Get("service")
 
 	if service == "" {
+		mFailures.Inc(pool, "bad_request")
 		http.Error(w, "Service name is missing", http.StatusBadRequest)
 		return
 	}
 
-	port, err := reg.Alloc(service)
+	port, err := register(origin(r), service)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusPreconditionFailed)
+		status := http.StatusPreconditionFailed
+		if failure(err) == "vetoed" {
+			status = http.StatusForbidden
+		}
+		http.Error(w, err.Error(), status)
 		return
 	}
 
-	flusher <- struct{}{}
+	notePort(w, port)
 
 	w.Header().Add("Content-Type", "text/plain")
 	fmt.Fprintf(w, "%d\n", port)
@@ -89,7 +108,7 @@ func del(w http.ResponseWriter, r *http.Request) {
 
 	cacheOff(w)
 
-	err = r.ParseForm()
+	err := r.ParseForm()
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
@@ -108,10 +127,285 @@ func del(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	reg.Forget(uint16(port))
-
-	flusher <- struct{}{}
+	release(origin(r), uint16(port))
+	notePort(w, uint16(port))
 
 	w.Header().Add("Content-Type", "text/plain")
 	fmt.Fprintln(w, "OK")
 }
+
+func export(w http.ResponseWriter, r *http.Request) {
+
+	cacheOff(w)
+
+	switch r.URL.Query().Get("format") {
+	case "", "dump":
+		w.Header().Add("Content-Type", "text/plain")
+		reg.Dump(w)
+	case "json":
+		w.Header().Add("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(reg.List())
+	default:
+		http.Error(w, "Unknown export format", http.StatusBadRequest)
+	}
+}
+
+// importSnapshot loads a snapshot from the request body. Parameters
+// are taken from the URL only, as the body is the snapshot itself.
+func importSnapshot(w http.ResponseWriter, r *http.Request) {
+
+	cacheOff(w)
+
+	if r.Method != "POST" && r.Method != "PUT" {
+		http.Error(w, "The snapshot must be sent in the request body", http.StatusMethodNotAllowed)
+		return
+	}
+
+	mode, err := registry.ParseImportMode(r.URL.Query().Get("mode"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	if format == "" && strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		format = "json"
+	}
+
+	var (
+		snapshot []registry.Entry
+		problems []registry.Problem
+	)
+
+	switch format {
+	case "", "dump":
+		snapshot, problems, err = registry.ParseDump(r.Body)
+	case "json":
+		err = json.NewDecoder(r.Body).Decode(&snapshot)
+	default:
+		err = fmt.Errorf("Unknown import format %q", format)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if len(problems) == 0 {
+		problems = reg.As(origin(r)).Import(snapshot, mode)
+	}
+
+	if len(problems) > 0 {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.WriteHeader(http.StatusConflict)
+		for _, p := range problems {
+			fmt.Fprintln(w, p)
+		}
+		return
+	}
+
+	flush()
+
+	w.Header().Add("Content-Type", "text/plain")
+	fmt.Fprintf(w, "OK %d\n", len(snapshot))
+}
+
+// stats serves the utilization of the port range
+func stats(w http.ResponseWriter, r *http.Request) {
+
+	cacheOff(w)
+
+	body := struct {
+		Pool string `json:"pool"`
+		registry.Stats
+	}{pool, reg.Stats()}
+
+	w.Header().Add("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(body)
+}
+
+// history serves the audit trail entries of a service, or of all
+// services, since a time given in RFC 3339 or as a duration back
+func history(w http.ResponseWriter, r *http.Request) {
+
+	cacheOff(w)
+
+	reloading.RLock()
+	trail := current.Audit
+	reloading.RUnlock()
+
+	if trail == nil {
+		http.Error(w, "Audit trail is disabled", http.StatusNotFound)
+		return
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var since time.Time
+
+	if s := r.Form.Get("since"); s != "" {
+		if d, derr := time.ParseDuration(s); derr == nil {
+			since = time.Now().Add(-d)
+		} else if since, err = time.Parse(time.RFC3339, s); err != nil {
+			http.Error(w, "The since parameter is neither a duration nor an RFC 3339 time", http.StatusBadRequest)
+			return
+		}
+	}
+
+	entries, err := trail.Query(r.Form.Get("service"), since)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if entries == nil {
+		entries = []audit.Entry{}
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entries)
+}
+
+// allocate assigns a port to the service, unless the pre alloc
+// hook vetoes it. The hook runs without holding the registry, on
+// a port reserved meanwhile. If the port still gets taken by an
+// import or a range change, another one is reserved.
+func allocate(o registry.Origin, service string) (port uint16, err error) {
+
+	hooks := currentHooks()
+	if hooks == nil || !hooks.HasPre(registry.EventAlloc) {
+		return reg.As(o).Alloc(service)
+	}
+
+	for {
+
+		port, err = reg.Reserve(service)
+		if err != nil {
+			return 0, err
+		}
+
+		ev := registry.Event{Kind: registry.EventAlloc, Entry: registry.Entry{Name: service, Port: port}}
+		if err = hooks.Pre(ev); err != nil {
+			reg.Unreserve(port)
+			return 0, err
+		}
+
+		err = reg.As(o).AllocAt(port, service)
+
+		var fault *registry.FaultError
+		if errors.As(err, &fault) && (fault.Fault == registry.FaultDupPort || fault.Fault == registry.FaultRange) {
+			continue
+		}
+
+		return port, err
+	}
+}
+
+// register allocates a port to the service, counting
+// and recording the outcome
+func register(o registry.Origin, service string) (uint16, error) {
+
+	port, err := allocate(o, service)
+	if err != nil {
+		mFailures.Inc(pool, failure(err))
+		return 0, err
+	}
+
+	mAllocs.Inc(pool)
+
+	flush()
+
+	return port, nil
+}
+
+// failure tells the reason of an allocation failure
+func failure(err error) string {
+
+	var (
+		vetoed *hook.Error
+		taken  *registry.NameTakenError
+		fault  *registry.FaultError
+	)
+
+	switch {
+	case errors.As(err, &vetoed):
+		return "vetoed"
+	case err == registry.ErrNoPorts:
+		return "exhausted"
+	case errors.As(err, &taken):
+		return "name_taken"
+	case errors.As(err, &fault) && fault.Fault == registry.FaultDupName:
+		return "name_taken"
+	case errors.As(err, &fault) && fault.Fault == registry.FaultDupPort:
+		return "port_taken"
+	}
+
+	return "other"
+}
+
+// release frees the port after running the pre release hook,
+// and returns the service released, if the port was taken
+func release(o registry.Origin, port uint16) (string, bool) {
+
+	if hooks := currentHooks(); hooks != nil && hooks.HasPre(registry.EventRelease) {
+		if e, ok := reg.At(port); ok {
+			ev := registry.Event{Kind: registry.EventRelease, Entry: e}
+			if err := hooks.Pre(ev); err != nil {
+				slog.Warn("Pre release hook failed, releasing anyway", "service", e.Name, "port", port, "err", err)
+			}
+		}
+	}
+
+	service, ok := reg.As(o).Forget(port)
+
+	if ok {
+		mReleases.Inc(pool)
+	}
+
+	flush()
+
+	return service, ok
+}
+
+func currentHooks() *hook.Runner {
+	reloading.RLock()
+	defer reloading.RUnlock()
+	return current.Hooks
+}
+
+// origin tells the registry the caller making the request
+func origin(r *http.Request) registry.Origin {
+	return registry.Origin{Caller: r.RemoteAddr, Client: r.Header.Get("X-Pald-Client")}
+}
+
+// audited returns the registry change hook recording every
+// allocation and release in the trail
+func audited(trail *audit.Log) func(registry.Event) {
+	return func(ev registry.Event) {
+
+		entry := audit.Entry{Service: ev.Name, Port: ev.Port, Caller: ev.Origin.Caller, Client: ev.Origin.Client}
+
+		switch ev.Kind {
+		case registry.EventAlloc:
+			entry.Event = audit.Alloc
+			if ev.Origin.Import {
+				entry.Event = audit.Import
+			}
+		case registry.EventRelease:
+			entry.Event = audit.Release
+		default:
+			return
+		}
+
+		if entry.Caller == "" && entry.Client == "" {
+			entry.Client = daemonClient
+		}
+
+		if err := trail.Record(entry); err != nil {
+			slog.Error("Failed to record the audit trail", "err", err)
+		}
+	}
+}
@@ -0,0 +1,162 @@
+/*
+	(c) Copyright 2015 Vlad Didenko
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	    http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/didenko/pald/internal/persist"
+)
+
+// health tracks the outcomes the readiness depends on
+var health struct {
+	sync.Mutex
+	started    time.Time
+	loadErr    error
+	persistErr error
+	persisted  time.Time
+}
+
+// Check is the outcome of a single readiness check
+type Check struct {
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// Status is the JSON body of the /healthz and /readyz responses
+type Status struct {
+	Status string           `json:"status"`
+	PID    int              `json:"pid,omitempty"`
+	Uptime string           `json:"uptime,omitempty"`
+	Checks map[string]Check `json:"checks,omitempty"`
+}
+
+func noteLoad(err error) {
+	health.Lock()
+	health.loadErr = err
+	health.Unlock()
+}
+
+func notePersist(err error) {
+	health.Lock()
+	health.persistErr = err
+	if err == nil {
+		health.persisted = time.Now()
+	}
+	health.Unlock()
+}
+
+// loaded reports the error which prevented loading the registry, if any
+func loaded() error {
+	health.Lock()
+	defer health.Unlock()
+	return health.loadErr
+}
+
+// requireLoaded makes the handler unavailable while the
+// registry is not loaded, so that it is neither served
+// nor persisted empty over the stored state
+func requireLoaded(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := loaded(); err != nil {
+			cacheOff(w)
+			http.Error(w, "The registry is not loaded: "+err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// unloaded stands for the store while its registry is not loaded
+type unloaded struct {
+	persist.Backend
+}
+
+func (unloaded) Save(src persist.Dumper) error {
+	return nil
+}
+
+func writeStatus(w http.ResponseWriter, st Status) {
+
+	cacheOff(w)
+	w.Header().Set("Content-Type", "application/json")
+
+	if st.Status != "ok" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+
+	json.NewEncoder(w).Encode(st)
+}
+
+// healthz reports that the process is alive and serving
+func healthz(w http.ResponseWriter, r *http.Request) {
+
+	health.Lock()
+	uptime := time.Since(health.started).Round(time.Second)
+	health.Unlock()
+
+	writeStatus(w, Status{Status: "ok", PID: os.Getpid(), Uptime: uptime.String()})
+}
+
+// readyz reports whether the registry is loaded, the last attempt
+// to persist it succeeded, and, unless disabled, ports are available
+func readyz(w http.ResponseWriter, r *http.Request) {
+
+	reloading.RLock()
+	exhaustedOK := !current.ReadyFailExhausted
+	reloading.RUnlock()
+
+	st := Status{Status: "ok", Checks: make(map[string]Check, 3)}
+
+	health.Lock()
+
+	if health.loadErr != nil {
+		st.Checks["load"] = Check{Detail: health.loadErr.Error()}
+	} else {
+		st.Checks["load"] = Check{OK: true}
+	}
+
+	switch {
+	case health.persistErr != nil:
+		st.Checks["persist"] = Check{Detail: health.persistErr.Error()}
+	case health.persisted.IsZero():
+		st.Checks["persist"] = Check{OK: true}
+	default:
+		st.Checks["persist"] = Check{OK: true, Detail: "saved at " + health.persisted.Format(time.RFC3339)}
+	}
+
+	health.Unlock()
+
+	size, used := reg.Usage()
+	st.Checks["pool"] = Check{
+		OK:     used < size || exhaustedOK,
+		Detail: fmt.Sprintf("%d of %d ports allocated", used, size),
+	}
+
+	for _, c := range st.Checks {
+		if !c.OK {
+			st.Status = "fail"
+		}
+	}
+
+	writeStatus(w, st)
+}
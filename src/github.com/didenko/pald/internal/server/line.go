@@ -0,0 +1,239 @@
+/*
+	(c) Copyright 2015 Vlad Didenko
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	    http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/didenko/pald/internal/registry"
+	"github.com/didenko/pald/internal/rpc"
+)
+
+// lineIdle is how long a line protocol connection may stay idle
+const lineIdle = 5 * time.Minute
+
+// lineServer serves the line protocol: one command per line, such as
+//
+//	GET name    replies with the port of the service
+//	SET name    allocates a port to the service and replies with it
+//	DEL port    releases the port and replies with it
+//	LIST        replies with a "name port" line per service and END
+//	QUIT        closes the connection
+//
+// A failed command gets an "ERR reason" reply.
+type lineServer struct {
+	ln    net.Listener
+	mu    sync.Mutex
+	conns map[net.Conn]struct{}
+	wg    sync.WaitGroup
+}
+
+var lineSrv *lineServer
+
+// serveLine starts the line protocol at the address, unless it is
+// empty, and then stops the previous listener, if any
+func serveLine(addr string) error {
+
+	var srv *lineServer
+
+	if addr != "" {
+
+		ln, err := rpc.Listen(addr)
+		if err != nil {
+			return err
+		}
+
+		srv = &lineServer{ln: ln, conns: make(map[net.Conn]struct{})}
+		srv.wg.Add(1)
+		go srv.serve()
+	}
+
+	old := lineSrv
+	lineSrv = srv
+
+	if old != nil {
+		go old.close()
+	}
+
+	return nil
+}
+
+// relistenLine applies a changed line protocol listener address
+func relistenLine(cfg Config) error {
+
+	if cfg.LineListen == current.LineListen {
+		return nil
+	}
+
+	if err := serveLine(cfg.LineListen); err != nil {
+		slog.Error("Reload failed to listen for the line protocol", "line_listen", cfg.LineListen, "err", err)
+		return err
+	}
+
+	slog.Info("Reload changed the line protocol listener", "line_listen", cfg.LineListen)
+	current.LineListen = cfg.LineListen
+
+	return nil
+}
+
+// close stops accepting, closes the connections and waits
+// for the commands in progress
+func (srv *lineServer) close() {
+
+	srv.ln.Close()
+
+	srv.mu.Lock()
+	for conn := range srv.conns {
+		conn.Close()
+	}
+	srv.mu.Unlock()
+
+	srv.wg.Wait()
+}
+
+func (srv *lineServer) serve() {
+
+	defer srv.wg.Done()
+
+	for {
+		conn, err := srv.ln.Accept()
+		if err != nil {
+			return
+		}
+
+		srv.mu.Lock()
+		srv.conns[conn] = struct{}{}
+		srv.mu.Unlock()
+
+		srv.wg.Add(1)
+		go func() {
+			defer srv.wg.Done()
+			serveLines(conn)
+			conn.Close()
+
+			srv.mu.Lock()
+			delete(srv.conns, conn)
+			srv.mu.Unlock()
+		}()
+	}
+}
+
+// serveLines runs the commands on the connection until it is
+// closed, idle for too long, or sends QUIT
+func serveLines(conn net.Conn) {
+
+	o := registry.Origin{Caller: conn.RemoteAddr().String()}
+
+	lines := bufio.NewScanner(conn)
+	out := bufio.NewWriter(conn)
+
+	for {
+		conn.SetDeadline(time.Now().Add(lineIdle))
+
+		if !lines.Scan() {
+			if err := lines.Err(); err == bufio.ErrTooLong {
+				fmt.Fprintln(out, "ERR Line is too long")
+				out.Flush()
+			}
+			return
+		}
+
+		fields := strings.Fields(lines.Text())
+		if len(fields) == 0 {
+			continue
+		}
+
+		command := strings.ToUpper(fields[0])
+		if command == "QUIT" {
+			return
+		}
+
+		if err := lineCommand(out, o, command, fields[1:]); err != nil {
+			fmt.Fprintln(out, "ERR", strings.ReplaceAll(err.Error(), "\n", " "))
+		}
+
+		if err := out.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// lineCommand runs the command and writes its reply, unless it fails
+func lineCommand(out io.Writer, o registry.Origin, command string, args []string) error {
+
+	switch command {
+	case "GET", "SET", "DEL":
+		if len(args) != 1 {
+			return fmt.Errorf("%s takes one argument", command)
+		}
+	case "LIST":
+		if len(args) != 0 {
+			return fmt.Errorf("%s takes no arguments", command)
+		}
+	default:
+		return fmt.Errorf("Unknown command %q", command)
+	}
+
+	start := time.Now()
+	defer func() {
+		mRequests.Observe(time.Since(start).Seconds(), "line_"+strings.ToLower(command))
+	}()
+
+	if err := loaded(); err != nil {
+		return fmt.Errorf("The registry is not loaded: %s", err)
+	}
+
+	switch command {
+	case "GET":
+		port, _, err := reg.Lookup(args[0])
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(out, port)
+
+	case "SET":
+		port, err := register(o, args[0])
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(out, port)
+
+	case "DEL":
+		port, err := strconv.ParseUint(args[0], 10, 16)
+		if err != nil {
+			return fmt.Errorf("Port %q is not a port number", args[0])
+		}
+		release(o, uint16(port))
+		fmt.Fprintln(out, port)
+
+	case "LIST":
+		for _, e := range reg.List() {
+			fmt.Fprintln(out, e.Name, e.Port)
+		}
+		fmt.Fprintln(out, "END")
+	}
+
+	return nil
+}
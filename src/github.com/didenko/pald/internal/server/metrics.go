@@ -0,0 +1,86 @@
+/*
+	(c) Copyright 2015 Vlad Didenko
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	    http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package server
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/didenko/pald/internal/metrics"
+	"github.com/didenko/pald/internal/persist"
+)
+
+// pool is the label value for the single configured port range
+const pool = "default"
+
+var (
+	mAllocs = metrics.NewCounter("pald_allocations_total",
+		"Ports allocated.", "pool")
+	mReleases = metrics.NewCounter("pald_releases_total",
+		"Ports released.", "pool")
+	mFailures = metrics.NewCounter("pald_allocation_failures_total",
+		"Failed allocation requests by reason.", "pool", "reason")
+	mRequests = metrics.NewHistogram("pald_request_duration_seconds",
+		"HTTP request latency by handler.", metrics.DefBuckets, "handler")
+	mPersist = metrics.NewHistogram("pald_persist_duration_seconds",
+		"Time to save the registry into the storage.", metrics.DefBuckets)
+	mPersistErrors = metrics.NewCounter("pald_persist_errors_total",
+		"Failed attempts to save the registry into the storage.")
+	mPersistLast = metrics.NewGauge("pald_persist_last_success_timestamp_seconds",
+		"Unix time of the last successful save of the registry.")
+
+	_ = metrics.NewGaugeFunc("pald_ports_allocated",
+		"Ports allocated in the range.", "pool",
+		func() map[string]float64 {
+			_, used := reg.Usage()
+			return map[string]float64{pool: float64(used)}
+		})
+	_ = metrics.NewGaugeFunc("pald_ports_free",
+		"Ports available for allocation in the range.", "pool",
+		func() map[string]float64 {
+			size, used := reg.Usage()
+			return map[string]float64{pool: float64(size - used)}
+		})
+)
+
+// metered records the duration and the outcome of every save
+type metered struct {
+	persist.Backend
+}
+
+func (m metered) Save(src persist.Dumper) error {
+
+	start := time.Now()
+	err := m.Backend.Save(src)
+	mPersist.Observe(time.Since(start).Seconds())
+
+	notePersist(err)
+
+	if err != nil {
+		mPersistErrors.Inc()
+		return err
+	}
+
+	mPersistLast.Set(float64(time.Now().UnixNano()) / 1e9)
+	return nil
+}
+
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	cacheOff(w)
+	w.Header().Add("Content-Type", "text/plain; version=0.0.4")
+	metrics.WriteTo(w)
+}
@@ -0,0 +1,244 @@
+/*
+	(c) Copyright 2015 Vlad Didenko
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	    http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/didenko/pald/internal/persist"
+)
+
+var (
+	// reloading serialises reloads and guards the flusher swaps
+	reloading sync.RWMutex
+
+	current Config
+	httpSrv *http.Server
+)
+
+// flush requests the registry to be persisted
+func flush() {
+	reloading.RLock()
+	flusher.Flush()
+	reloading.RUnlock()
+}
+
+// serve starts serving HTTP on the port and then gracefully
+// stops the previous listener, if any
+func serve(port uint16) error {
+
+	ln, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return err
+	}
+
+	srv := &http.Server{Handler: http.DefaultServeMux}
+
+	go func() {
+		if err := srv.Serve(ln); err != http.ErrServerClosed {
+			fatal <- err
+		}
+	}()
+
+	old := httpSrv
+	httpSrv = srv
+
+	if old != nil {
+		go stop(old)
+	}
+
+	return nil
+}
+
+// stop shuts the server down gracefully, closing
+// the connections still busy after a timeout
+func stop(srv *http.Server) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if srv.Shutdown(ctx) != nil {
+		// Streaming watchers never go idle
+		srv.Close()
+	}
+}
+
+// relistenGRPC applies a changed gRPC listener address
+func relistenGRPC(cfg Config) error {
+
+	if cfg.GRPCListen == current.GRPCListen {
+		return nil
+	}
+
+	if err := serveGRPC(cfg.GRPCListen); err != nil {
+		slog.Error("Reload failed to listen for gRPC", "grpc_listen", cfg.GRPCListen, "err", err)
+		return err
+	}
+
+	slog.Info("Reload changed the gRPC listener", "grpc_listen", cfg.GRPCListen)
+	current.GRPCListen = cfg.GRPCListen
+
+	return nil
+}
+
+// retry loads the registry which failed to load before, using
+// the new configuration as a whole
+func retry(cfg Config) error {
+
+	flusher.Close()
+
+	_, err := reg.SetRange(cfg.PortMin, cfg.PortMax)
+	if err != nil {
+		slog.Error("Reload failed to change the range", "port_min", cfg.PortMin, "port_max", cfg.PortMax, "err", err)
+		flusher = persist.Persist(reg, unloaded{current.Store}, 0)
+		return err
+	}
+
+	current.PortMin = cfg.PortMin
+	current.PortMax = cfg.PortMax
+	current.Store = cfg.Store
+	current.Throttle = cfg.Throttle
+
+	load(current)
+
+	if cfg.Listen != current.Listen {
+		if err := serve(cfg.Listen); err != nil {
+			slog.Error("Reload failed to listen", "listen", cfg.Listen, "err", err)
+			return err
+		}
+		current.Listen = cfg.Listen
+	}
+
+	if err := relistenGRPC(cfg); err != nil {
+		return err
+	}
+
+	if err := relistenLine(cfg); err != nil {
+		return err
+	}
+
+	if err := relistenDNS(cfg); err != nil {
+		return err
+	}
+
+	if err := loaded(); err != nil {
+		return err
+	}
+
+	slog.Info("Reload loaded the registry")
+	return nil
+}
+
+// Reload applies a changed configuration to the running server without
+// dropping the registry. The port range is changed with the configured
+// policies, as on startup. A new store gets the current registry saved
+// into it and is used for the following changes. The changes are applied
+// one by one, and failing one does not prevent the others. The caller
+// keeps the ownership of both the old and the new stores and should
+// close the one not in the returned current configuration. If the
+// registry failed to load before, Reload tries to load it again.
+func Reload(cfg Config) (Config, error) {
+
+	reloading.Lock()
+	defer reloading.Unlock()
+
+	var failed []string
+
+	reg.SetLoadPolicy(cfg.Policy)
+	reg.SetRangePolicy(cfg.Ranging)
+	reg.SetWatermarks(cfg.Watermarks)
+	current.Policy = cfg.Policy
+	current.Ranging = cfg.Ranging
+	current.Watermarks = cfg.Watermarks
+	current.AccessLog = cfg.AccessLog
+	current.ReadyFailExhausted = cfg.ReadyFailExhausted
+
+	configureDNS(cfg.DNSZone, cfg.DNSTTL)
+	current.DNSZone = cfg.DNSZone
+	current.DNSTTL = cfg.DNSTTL
+
+	if loaded() != nil {
+		return current, retry(cfg)
+	}
+
+	if cfg.PortMin != current.PortMin || cfg.PortMax != current.PortMax {
+
+		problems, err := reg.SetRange(cfg.PortMin, cfg.PortMax)
+		if err != nil {
+			slog.Error("Reload failed to change the range", "port_min", cfg.PortMin, "port_max", cfg.PortMax, "err", err)
+			failed = append(failed, "range")
+		} else {
+			slog.Info("Reload changed the range", "port_min", cfg.PortMin, "port_max", cfg.PortMax)
+			report(problems)
+			current.PortMin = cfg.PortMin
+			current.PortMax = cfg.PortMax
+		}
+	}
+
+	if cfg.Store != current.Store || cfg.Throttle != current.Throttle {
+
+		if err := (metered{cfg.Store}).Save(reg); err != nil {
+			slog.Error("Reload failed to switch the storage", "err", err)
+			failed = append(failed, "storage")
+		} else {
+			flusher.Close()
+			flusher = persist.Persist(reg, metered{cfg.Store}, cfg.Throttle)
+			slog.Info("Reload switched the storage")
+			current.Store = cfg.Store
+			current.Throttle = cfg.Throttle
+		}
+	} else {
+		flusher.Flush()
+	}
+
+	if cfg.Listen != current.Listen {
+
+		if err := serve(cfg.Listen); err != nil {
+			slog.Error("Reload failed to listen", "listen", cfg.Listen, "err", err)
+			failed = append(failed, "listener")
+		} else {
+			slog.Info("Reload changed the listener", "listen", cfg.Listen)
+			current.Listen = cfg.Listen
+		}
+	}
+
+	if relistenGRPC(cfg) != nil {
+		failed = append(failed, "gRPC listener")
+	}
+
+	if relistenLine(cfg) != nil {
+		failed = append(failed, "line protocol listener")
+	}
+
+	if relistenDNS(cfg) != nil {
+		failed = append(failed, "DNS listener")
+	}
+
+	if len(failed) > 0 {
+		return current, fmt.Errorf("Reload failed to change the %s", strings.Join(failed, ", "))
+	}
+
+	slog.Info("Reload complete")
+	return current, nil
+}
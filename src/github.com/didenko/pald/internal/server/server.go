@@ -18,46 +18,236 @@ package server
 
 import (
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
-	"os"
+	"sort"
+	"strings"
 	"time"
 
+	"github.com/didenko/pald/internal/audit"
+	"github.com/didenko/pald/internal/hook"
 	"github.com/didenko/pald/internal/persist"
 	"github.com/didenko/pald/internal/registry"
+	"github.com/didenko/pald/internal/webhook"
 )
 
 var (
 	reg *registry.Registry
-	err error
 
-	flusher chan struct{}
+	flusher *persist.Persister
+	fatal   = make(chan error, 1)
 )
 
 func init() {
-	http.HandleFunc("/get", get)
-	http.HandleFunc("/set", set)
-	http.HandleFunc("/del", del)
+	http.HandleFunc("/get", instrument("get", requireLoaded(get)))
+	http.HandleFunc("/set", instrument("set", requireLoaded(set)))
+	http.HandleFunc("/del", instrument("del", requireLoaded(del)))
+	http.HandleFunc("/export", instrument("export", requireLoaded(export)))
+	http.HandleFunc("/import", instrument("import", requireLoaded(importSnapshot)))
+	http.HandleFunc("/history", instrument("history", history))
+	http.HandleFunc("/stats", instrument("stats", requireLoaded(stats)))
+	http.HandleFunc("/v1/catalog/services", consulInstrument("consul_services", requireLoaded(consulServices)))
+	http.HandleFunc("/v1/catalog/service/", consulInstrument("consul_catalog", requireLoaded(consulCatalog)))
+	http.HandleFunc("/v1/health/service/", consulInstrument("consul_health", requireLoaded(consulHealthService)))
+	http.HandleFunc("/metrics", metricsHandler)
+	http.HandleFunc("/watch", watch)
+	http.HandleFunc("/healthz", healthz)
+	http.HandleFunc("/readyz", readyz)
 }
 
-func Run(portSvr, portMin, portMax uint16, dumpName string) {
+// Config holds the settings of the server
+type Config struct {
+	Listen   uint16
+	PortMin  uint16
+	PortMax  uint16
+	Store    persist.Backend
+	Throttle time.Duration
+	Policy   registry.LoadPolicy
+	Ranging  registry.RangePolicy
+
+	// GRPCListen is where to serve gRPC, a unix:/path socket,
+	// a host:port or a port, or nowhere if empty
+	GRPCListen string
+
+	// LineListen is where to serve the line protocol, a unix:/path
+	// socket, a host:port or a port, or nowhere if empty
+	LineListen string
+
+	// DNSListen is the UDP and TCP address of the DNS responder,
+	// like 127.0.0.1:5353, or nowhere if empty
+	DNSListen string
+
+	// DNSZone is the domain the DNS responder is authoritative for
+	DNSZone string
+
+	// DNSTTL is the time the DNS answers may be cached
+	DNSTTL time.Duration
+
+	// AccessLog enables a log record per request
+	AccessLog bool
+
+	// ReadyFailExhausted makes /readyz fail while all ports are allocated
+	ReadyFailExhausted bool
+
+	// Watermarks are the range utilization percentages
+	// to warn about when crossed
+	Watermarks []int
+
+	// Audit is the trail of changes, nil if disabled.
+	// It is not changed by Reload.
+	Audit *audit.Log
+
+	// Webhooks receive the registry changes, nil if none.
+	// They are not changed by Reload.
+	Webhooks *webhook.Dispatcher
+
+	// Hooks run local commands on the registry changes, nil
+	// if none. They are not changed by Reload.
+	Hooks *hook.Runner
+}
+
+// report logs what happened to the invalid and out of range
+// records while loading the stored state or changing the range
+func report(problems []registry.Problem) {
+
+	if len(problems) == 0 {
+		return
+	}
+
+	actions := make(map[string]int)
+
+	for _, p := range problems {
+		slog.Warn("Registry record outside of the range or invalid",
+			"line", p.Line, "fault", p.Fault, "detail", p.Detail, "record", p.Text, "action", p.Action)
+
+		action := p.Action
+		if strings.HasPrefix(action, "moved") {
+			action = "moved"
+		}
+		actions[action]++
+	}
+
+	summary := make([]string, 0, len(actions))
+	for action, count := range actions {
+		summary = append(summary, fmt.Sprintf("%d %s", count, action))
+	}
+	sort.Strings(summary)
+
+	slog.Warn("Registry records outside of the range or invalid", "summary", strings.Join(summary, ", "))
+}
+
+// Run loads the registry from the store and serves it until
+// a fatal error, which it returns. If the registry fails to load,
+// the server still runs to report it by /readyz, but serves no
+// registry requests until a Reload loads it. Once Run returns,
+// nothing is saved to the store anymore.
+func Run(cfg Config) error {
+
+	reloading.Lock()
+
+	err := start(cfg)
+
+	reloading.Unlock()
 
-	reg, err = registry.New(portMin, portMax)
 	if err != nil {
-		log.Panic(err)
+		return err
 	}
 
-	dump, err := os.OpenFile(dumpName, os.O_RDWR|os.O_CREATE, 0660)
+	err = <-fatal
+
+	reloading.Lock()
+	flusher.Close()
+	reloading.Unlock()
+
+	return err
+}
+
+func start(cfg Config) error {
+
+	var err error
+
+	reg, err = registry.New(cfg.PortMin, cfg.PortMax)
 	if err != nil {
-		log.Panic(err)
+		return err
+	}
+
+	reg.SetLoadPolicy(cfg.Policy)
+	reg.SetRangePolicy(cfg.Ranging)
+	reg.SetWatermarks(cfg.Watermarks)
+	reg.Notify(publish)
+	reg.Notify(warnWatermark)
+	if cfg.Webhooks != nil {
+		reg.Notify(cfg.Webhooks.Send)
+	}
+	if cfg.Hooks != nil {
+		reg.Notify(cfg.Hooks.Post)
 	}
+	if cfg.Audit != nil {
+		reg.Notify(audited(cfg.Audit))
+	}
+
+	health.Lock()
+	health.started = time.Now()
+	health.Unlock()
+
+	load(cfg)
+
+	current = cfg
+
+	if err = serve(cfg.Listen); err != nil {
+		return err
+	}
+
+	if err = serveGRPC(cfg.GRPCListen); err != nil {
+		return err
+	}
+
+	if err = serveLine(cfg.LineListen); err != nil {
+		return err
+	}
+
+	configureDNS(cfg.DNSZone, cfg.DNSTTL)
+
+	return serveDNS(cfg.DNSListen)
+}
+
+// load fills the registry from the store and starts persisting it.
+// A registry which failed to load is not persisted, so that the
+// stored state is not overwritten.
+func load(cfg Config) {
+
+	err := cfg.Store.Load(reg)
+	noteLoad(err)
 
-	err = persist.Load(dump, reg)
 	if err != nil {
-		log.Panic(err)
+		slog.Error("Failed to load the registry", "err", err)
+		flusher = persist.Persist(reg, unloaded{cfg.Store}, 0)
+		return
+	}
+
+	report(reg.Problems())
+
+	if st := reg.Stats(); len(st.Crossed) > 0 {
+		slog.Warn("Port range utilization is above the watermark",
+			"pool", pool, "watermark", st.Crossed[len(st.Crossed)-1], "used", st.Used, "size", st.Size)
 	}
 
-	flusher = persist.Persist(reg, dump, time.Second)
+	flusher = persist.Persist(reg, metered{cfg.Store}, cfg.Throttle)
+}
+
+// warnWatermark logs the crossed watermarks
+func warnWatermark(ev registry.Event) {
 
-	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", portSvr), nil))
+	wm := ev.Watermark
+	if wm == nil {
+		return
+	}
+
+	if wm.Rising {
+		slog.Warn("Port range utilization rose above the watermark",
+			"pool", pool, "watermark", wm.Percent, "used", wm.Used, "size", wm.Size)
+	} else {
+		slog.Info("Port range utilization fell below the watermark",
+			"pool", pool, "watermark", wm.Percent, "used", wm.Used, "size", wm.Size)
+	}
 }
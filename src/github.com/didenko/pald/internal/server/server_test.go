@@ -18,20 +18,133 @@ package server
 
 import (
 	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
 	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"reflect"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
-)
+	"time"
 
-const (
-	testPort uint16 = 8001
+	"github.com/didenko/pald/internal/audit"
+	"github.com/didenko/pald/internal/hook"
+	"github.com/didenko/pald/internal/persist"
+	"github.com/didenko/pald/internal/registry"
+	"github.com/didenko/pald/internal/rpc"
 )
 
-var (
-	testUrl string = "http://localhost:" + strconv.Itoa(int(testPort))
-)
+// testServer starts a server of the test's own on a free port, with
+// the registry in a temporary dump file holding the dump, and returns
+// its URL. The port range defaults to 49200-49202. The previous test
+// server stops serving HTTP, gRPC, the line protocol and DNS.
+func testServer(t *testing.T, cfg Config, dump string) string {
+
+	t.Helper()
+
+	if cfg.Store == nil {
+		name := filepath.Join(t.TempDir(), "dump")
+		if err := os.WriteFile(name, []byte(dump), 0600); err != nil {
+			t.Fatal(err)
+		}
+		store, err := persist.OpenFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg.Store = store
+	}
+
+	if cfg.PortMin == 0 && cfg.PortMax == 0 {
+		cfg.PortMin, cfg.PortMax = 49200, 49202
+	}
+
+	if cfg.Listen == 0 {
+		cfg.Listen = freePort(t)
+	}
+
+	reloading.Lock()
+	stopTestServer()
+	err := start(cfg)
+	reloading.Unlock()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return "http://localhost:" + strconv.Itoa(int(cfg.Listen))
+}
+
+// stopTestServer stops the previous test server, waiting for the
+// listeners using the registry to stop before it gets replaced
+func stopTestServer() {
+
+	if httpSrv != nil {
+		httpSrv.Close()
+		httpSrv = nil
+	}
+	if grpcSrv != nil {
+		grpcSrv.Close()
+		grpcSrv = nil
+	}
+	if lineSrv != nil {
+		lineSrv.close()
+		lineSrv = nil
+	}
+	if dnsSrv != nil {
+		dnsSrv.Close()
+		dnsSrv = nil
+	}
+	if flusher != nil {
+		flusher.Close()
+	}
+}
+
+// freePort returns a TCP port nothing listens at
+func freePort(t *testing.T) uint16 {
+
+	ln, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	return uint16(ln.Addr().(*net.TCPAddr).Port)
+}
+
+// metric returns the value of the series served at /metrics, or 0
+// if the series is not there yet
+func metric(t *testing.T, url, series string) float64 {
+
+	resp, err := http.Get(url + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	lines := bufio.NewScanner(resp.Body)
+	for lines.Scan() {
+		if value, ok := strings.CutPrefix(lines.Text(), series+" "); ok {
+			v, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return v
+		}
+	}
+
+	return 0
+}
 
 func TestPaldHttp(t *testing.T) {
 
@@ -39,6 +152,7 @@ func TestPaldHttp(t *testing.T) {
 		request  string
 		httpCode int
 		respFore string
+		body     string
 	}{
 		{request: "/set?service=a0", httpCode: http.StatusOK, respFore: "49200"},
 		{request: "/set?service=a1", httpCode: http.StatusOK, respFore: "49201"},
@@ -55,19 +169,44 @@ func TestPaldHttp(t *testing.T) {
 		{request: "/del?port=492O1", httpCode: http.StatusBadRequest, respFore: "strconv.ParseUint:"},
 		{request: "/set?sevice=er", httpCode: http.StatusBadRequest, respFore: "Service name is missing"},
 		{request: "/del?svc=er", httpCode: http.StatusBadRequest, respFore: "Port number is missing"},
+		{request: "/export", httpCode: http.StatusOK, respFore: "a0\t49200\t"},
+		{request: "/export?format=json", httpCode: http.StatusOK, respFore: `[{"name":"a0","port":49200},{"name":"a3","port":49201}`},
+		{request: "/export?format=xml", httpCode: http.StatusBadRequest, respFore: "Unknown export format"},
+		{request: "/import", httpCode: http.StatusMethodNotAllowed, respFore: "The snapshot must be sent"},
+		{request: "/import", body: "a0\t49201\t\n", httpCode: http.StatusConflict, respFore: "line 1: duplicate name"},
+		{request: "/import?mode=replace", body: "b0\t49202\t\n", httpCode: http.StatusOK, respFore: "OK 1"},
+		{request: "/get?service=b0", httpCode: http.StatusOK, respFore: "49202"},
+		{request: "/get?service=a0", httpCode: http.StatusNotFound, respFore: "Name \"a0\" not found"},
+		{request: "/metrics", httpCode: http.StatusOK, respFore: "# HELP pald_allocations_total"},
+		{request: "/history?service=zz", httpCode: http.StatusOK, respFore: "[]"},
+		{request: "/history?since=yesterday", httpCode: http.StatusBadRequest, respFore: "The since parameter"},
 	}
 
-	go Run(testPort, 49200, 49202, "./dump.tmp")
+	trail, err := audit.Open(filepath.Join(t.TempDir(), "audit"), 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer trail.Close()
 
-	defer os.Remove("./dump.tmp")
+	url := testServer(t, Config{Throttle: time.Second, Audit: trail}, "")
 
 	for _, tc := range testCases {
 
-		resp, err := http.Get(testUrl + tc.request)
-		defer resp.Body.Close()
+		var (
+			resp *http.Response
+			err  error
+		)
+
+		if tc.body == "" {
+			resp, err = http.Get(url + tc.request)
+		} else {
+			resp, err = http.Post(url+tc.request, "text/plain", strings.NewReader(tc.body))
+		}
 		if err != nil {
 			t.Error(err)
+			continue
 		}
+		defer resp.Body.Close()
 
 		if resp.StatusCode != tc.httpCode {
 			t.Errorf("Received code %d instead of %d from %q request", resp.StatusCode, tc.httpCode, tc.request)
@@ -79,3 +218,839 @@ func TestPaldHttp(t *testing.T) {
 		}
 	}
 }
+
+func TestReload(t *testing.T) {
+
+	testServer(t, Config{}, "b0\t49202\t\n")
+
+	reloading.RLock()
+	cfg := current
+	reloading.RUnlock()
+
+	cfg.Listen = freePort(t)
+	cfg.PortMin = 49202
+	cfg.PortMax = 49203
+
+	applied, err := Reload(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(applied, cfg) {
+		t.Errorf("Applied configuration %v differs from requested %v", applied, cfg)
+	}
+
+	url := "http://localhost:" + strconv.Itoa(int(cfg.Listen))
+
+	for request, expected := range map[string]string{
+		"/get?service=b0": "49202",
+		"/set?service=c0": "49203",
+	} {
+		resp, err := http.Get(url + request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		line, _ := bufio.NewReader(resp.Body).ReadString('\n')
+		resp.Body.Close()
+		if !strings.HasPrefix(line, expected) {
+			t.Errorf("Request %q after reload returned %q instead of %q", request, line, expected)
+		}
+	}
+
+	cfg.PortMin = 49203
+	cfg.PortMax = 49202
+
+	if applied, err = Reload(cfg); err == nil {
+		t.Error("Reloading with flipped boundaries should fail")
+	}
+	if applied.PortMin != 49202 || applied.PortMax != 49203 {
+		t.Error("A failed range change should keep the range")
+	}
+}
+
+func TestSwitchStorage(t *testing.T) {
+
+	dir := t.TempDir()
+
+	open := func(name string) persist.Backend {
+		store, err := persist.OpenFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { store.Close() })
+		return store
+	}
+
+	url := testServer(t, Config{Store: open("old"), Throttle: time.Hour}, "")
+
+	resp, err := http.Get(url + "/set?service=s0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	reloading.RLock()
+	cfg := current
+	reloading.RUnlock()
+
+	cfg.Store = open("new")
+
+	if _, err = Reload(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"old", "new"} {
+		if b, _ := os.ReadFile(filepath.Join(dir, name)); string(b) != "s0\t49200\t\n" {
+			t.Errorf("The %s storage holds %q after the switch", name, b)
+		}
+	}
+}
+
+func TestMetrics(t *testing.T) {
+
+	url := testServer(t, Config{PortMin: 49200, PortMax: 49201}, "")
+
+	counters := []string{
+		`pald_allocations_total{pool="default"}`,
+		`pald_releases_total{pool="default"}`,
+		`pald_allocation_failures_total{pool="default",reason="bad_request"}`,
+		`pald_allocation_failures_total{pool="default",reason="exhausted"}`,
+		`pald_allocation_failures_total{pool="default",reason="name_taken"}`,
+		`pald_request_duration_seconds_count{handler="get"}`,
+		`pald_persist_errors_total`,
+	}
+
+	before := make(map[string]float64)
+	for _, series := range counters {
+		before[series] = metric(t, url, series)
+	}
+
+	for _, request := range []string{
+		"/set?service=m0",
+		"/set?service=m1",
+		"/set?service=m2",
+		"/set?service=m0",
+		"/set?svc=m3",
+		"/get?service=m0",
+		"/del?port=49201",
+	} {
+		resp, err := http.Get(url + request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	for i, delta := range []float64{2, 1, 1, 1, 1, 1, 0} {
+		if got := metric(t, url, counters[i]) - before[counters[i]]; got != delta {
+			t.Errorf("Metric %s grew by %v instead of %v", counters[i], got, delta)
+		}
+	}
+
+	for series, value := range map[string]float64{
+		`pald_ports_allocated{pool="default"}`: 1,
+		`pald_ports_free{pool="default"}`:      1,
+	} {
+		if got := metric(t, url, series); got != value {
+			t.Errorf("Metric %s is %v instead of %v", series, got, value)
+		}
+	}
+}
+
+func TestFailure(t *testing.T) {
+
+	r, _ := registry.New(10, 10)
+	r.Alloc("a")
+
+	_, taken := r.Alloc("a")
+	_, exhausted := r.Alloc("b")
+
+	for _, tc := range []struct {
+		err    error
+		reason string
+	}{
+		{&hook.Error{Command: "veto"}, "vetoed"},
+		{exhausted, "exhausted"},
+		{taken, "name_taken"},
+		{r.AllocAt(10, "a"), "name_taken"},
+		{r.AllocAt(10, "c"), "port_taken"},
+		{errors.New("Something else"), "other"},
+	} {
+		if reason := failure(tc.err); reason != tc.reason {
+			t.Errorf("The failure %v is counted as %q instead of %q", tc.err, reason, tc.reason)
+		}
+	}
+}
+
+func TestAccessLog(t *testing.T) {
+
+	var buf bytes.Buffer
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewTextHandler(&buf, nil)))
+
+	reloading.Lock()
+	enabled := current.AccessLog
+	current.AccessLog = true
+	reloading.Unlock()
+
+	defer func() {
+		reloading.Lock()
+		current.AccessLog = enabled
+		reloading.Unlock()
+	}()
+
+	handler := instrument("test", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		notePort(w, 49201)
+		http.Error(w, "test", http.StatusTeapot)
+	})
+
+	handler(httptest.NewRecorder(), httptest.NewRequest("GET", "/test?service=svc", nil))
+
+	record := buf.String()
+	for _, attr := range []string{"msg=access", "handler=test", "status=418", "service=svc", "port=49201", "latency="} {
+		if !strings.Contains(record, attr) {
+			t.Errorf("Access log record %q misses %q", record, attr)
+		}
+	}
+}
+
+func TestHistory(t *testing.T) {
+
+	trail, err := audit.Open(filepath.Join(t.TempDir(), "audit"), 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer trail.Close()
+
+	url := testServer(t, Config{Audit: trail}, "")
+
+	for _, request := range []string{"/set?service=a0", "/set?service=a1", "/del?port=49201"} {
+		resp, err := http.Get(url + request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	resp, err := http.Get(url + "/history?service=a1&since=1h")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var entries []audit.Entry
+	if err = json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries) != 2 ||
+		entries[0].Event != audit.Alloc || entries[0].Port != 49201 ||
+		entries[1].Event != audit.Release || entries[1].Port != 49201 ||
+		!strings.HasPrefix(entries[1].Caller, "127.0.0.1:") {
+		t.Errorf("Unexpected history %v", entries)
+	}
+}
+
+func TestHealth(t *testing.T) {
+
+	url := testServer(t, Config{PortMin: 49202, PortMax: 49202}, "b0\t49202\t\n")
+
+	probe := func(path string, code int) Status {
+		resp, err := http.Get(url + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != code {
+			t.Errorf("Received code %d instead of %d from %q", resp.StatusCode, code, path)
+		}
+
+		var st Status
+		json.NewDecoder(resp.Body).Decode(&st)
+		return st
+	}
+
+	if st := probe("/healthz", http.StatusOK); st.Status != "ok" || st.PID != os.Getpid() {
+		t.Errorf("Unexpected health %+v", st)
+	}
+
+	if st := probe("/readyz", http.StatusOK); !st.Checks["pool"].OK || !st.Checks["persist"].OK {
+		t.Errorf("Unexpected readiness %+v", st)
+	}
+
+	reloading.Lock()
+	current.ReadyFailExhausted = true
+	reloading.Unlock()
+
+	if st := probe("/readyz", http.StatusServiceUnavailable); st.Checks["pool"].OK {
+		t.Errorf("An exhausted pool should fail readiness: %+v", st)
+	}
+
+	reloading.Lock()
+	current.ReadyFailExhausted = false
+	reloading.Unlock()
+
+	noteLoad(errors.New("test"))
+
+	if st := probe("/readyz", http.StatusServiceUnavailable); st.Checks["load"].Detail != "test" {
+		t.Errorf("A failed load should fail readiness: %+v", st)
+	}
+	probe("/get?service=b0", http.StatusServiceUnavailable)
+
+	noteLoad(nil)
+
+	probe("/get?service=b0", http.StatusOK)
+}
+
+func TestWatch(t *testing.T) {
+
+	url := testServer(t, Config{PortMin: 49202, PortMax: 49202}, "")
+
+	type sse struct{ id, event, data string }
+
+	open := func(query, token string) (*bufio.Reader, func()) {
+		req, _ := http.NewRequest("GET", url+"/watch"+query, nil)
+		if token != "" {
+			req.Header.Set("Last-Event-ID", token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+			t.Errorf("Unexpected content type %q", ct)
+		}
+		return bufio.NewReader(resp.Body), func() { resp.Body.Close() }
+	}
+
+	next := func(rd *bufio.Reader) (ev sse) {
+		for {
+			line, err := rd.ReadString('\n')
+			if err != nil {
+				t.Fatal(err)
+			}
+			switch line = strings.TrimSuffix(line, "\n"); {
+			case line == "" && ev.event != "":
+				return ev
+			case strings.HasPrefix(line, "id: "):
+				ev.id = line[4:]
+			case strings.HasPrefix(line, "event: "):
+				ev.event = line[7:]
+			case strings.HasPrefix(line, "data: "):
+				ev.data = line[6:]
+			}
+		}
+	}
+
+	call := func(request string) {
+		resp, err := http.Get(url + request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	rd, done := open("?prefix=w", "")
+
+	call("/set?service=w0")
+
+	ev := next(rd)
+	done()
+
+	var alloc Event
+	json.Unmarshal([]byte(ev.data), &alloc)
+
+	if ev.event != "alloc" || alloc.Service != "w0" || alloc.Port != 49202 || alloc.ID != ev.id {
+		t.Errorf("Unexpected event %+v", ev)
+	}
+
+	call("/del?port=49202")
+
+	rd, done = open("", ev.id)
+	if ev = next(rd); ev.event != "release" || !strings.Contains(ev.data, `"service":"w0"`) {
+		t.Errorf("Resuming after %q returned %+v", alloc.ID, ev)
+	}
+	done()
+
+	rd, done = open("?since=stale-1", "")
+	if ev = next(rd); ev.event != "reset" {
+		t.Errorf("Resuming with a stale token returned %+v", ev)
+	}
+	done()
+}
+
+func TestHooks(t *testing.T) {
+
+	hooks := hook.New(hook.Commands{
+		PreAlloc: []string{"sh", "-c", `test "$PALD_SERVICE" != blocked`},
+	})
+	defer hooks.Close()
+
+	url := testServer(t, Config{PortMin: 49202, PortMax: 49202, Hooks: hooks}, "")
+
+	for _, tc := range []struct {
+		request string
+		code    int
+	}{
+		{"/set?service=blocked", http.StatusForbidden},
+		{"/get?service=blocked", http.StatusNotFound},
+		{"/set?service=allowed", http.StatusOK},
+		{"/del?port=49202", http.StatusOK},
+	} {
+		resp, err := http.Get(url + tc.request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tc.code {
+			t.Errorf("Received code %d instead of %d from %q", resp.StatusCode, tc.code, tc.request)
+		}
+	}
+}
+
+func TestConcurrentHooks(t *testing.T) {
+
+	hooks := hook.New(hook.Commands{PreAlloc: []string{"true"}})
+	defer hooks.Close()
+
+	const n = 20
+
+	url := testServer(t, Config{PortMin: 49200, PortMax: 49200 + n - 1, Hooks: hooks}, "")
+
+	var wg sync.WaitGroup
+	codes := make(chan int, n)
+
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			resp, err := http.Get(fmt.Sprintf("%s/set?service=h%d", url, i))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			resp.Body.Close()
+			codes <- resp.StatusCode
+		}(i)
+	}
+
+	wg.Wait()
+	close(codes)
+
+	for code := range codes {
+		if code != http.StatusOK {
+			t.Errorf("Received code %d while %d ports were enough for all", code, n)
+		}
+	}
+}
+
+func TestStats(t *testing.T) {
+
+	url := testServer(t, Config{PortMin: 49201, PortMax: 49202}, "c0\t49201\t\n")
+
+	resp, err := http.Get(url + "/stats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var st struct {
+		Pool string `json:"pool"`
+		registry.Stats
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&st); err != nil {
+		t.Fatal(err)
+	}
+
+	if st.Pool != "default" || st.Size != 2 || st.Used != 1 || st.Grandfathered != 0 ||
+		st.LargestFree == nil || st.LargestFree.From != 49202 || st.Oldest != nil {
+		t.Errorf("Unexpected stats %+v", st)
+	}
+
+	resp, err = http.Get(url + "/set?service=c1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	resp, err = http.Get(url + "/stats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if err = json.NewDecoder(resp.Body).Decode(&st); err != nil {
+		t.Fatal(err)
+	}
+
+	if st.Used != 2 || st.Oldest == nil || st.Oldest.Name != "c1" {
+		t.Errorf("Unexpected stats after an allocation %+v", st)
+	}
+}
+
+// grpcClient calls the gRPC listener at the unix socket
+func grpcClient(socket string) *http.Client {
+
+	tr := &http.Transport{
+		Protocols: new(http.Protocols),
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+		},
+	}
+	tr.Protocols.SetUnencryptedHTTP2(true)
+
+	return &http.Client{Transport: tr}
+}
+
+// grpcCall makes a call and passes the response messages to fn
+// until it returns false, then returns the grpc-status
+func grpcCall(ctx context.Context, client *http.Client, method string, req rpc.Message, fn func([]byte) bool) (string, error) {
+
+	frame := []byte{0, 0, 0, 0, byte(len(req))}
+	body := bytes.NewReader(append(frame, req...))
+
+	hr, err := http.NewRequestWithContext(ctx, "POST", "http://pald"+grpcService+method, body)
+	if err != nil {
+		return "", err
+	}
+	hr.Header.Set("Content-Type", "application/grpc")
+
+	resp, err := client.Do(hr)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	for {
+		var head [5]byte
+		if _, err = io.ReadFull(resp.Body, head[:]); err != nil {
+			break
+		}
+		msg := make([]byte, binary.BigEndian.Uint32(head[1:]))
+		if _, err = io.ReadFull(resp.Body, msg); err != nil || !fn(msg) {
+			break
+		}
+	}
+
+	return resp.Trailer.Get("Grpc-Status"), nil
+}
+
+func TestGRPC(t *testing.T) {
+
+	socket := filepath.Join(t.TempDir(), "grpc")
+
+	testServer(t, Config{PortMin: 49202, PortMax: 49203, GRPCListen: "unix:" + socket}, "c0\t49203\t\n")
+
+	client := grpcClient(socket)
+	ctx := context.Background()
+
+	events := make(chan []byte, 10)
+	watchCtx, stopWatch := context.WithCancel(ctx)
+	defer stopWatch()
+
+	var prefix rpc.Message
+	prefix.String(3, "g")
+	go grpcCall(watchCtx, client, "Watch", prefix, func(msg []byte) bool {
+		events <- msg
+		return true
+	})
+	time.Sleep(100 * time.Millisecond)
+
+	named := func(name string) rpc.Message {
+		var m rpc.Message
+		m.String(1, name)
+		return m
+	}
+
+	var port rpc.Message
+	port.Uint(1, 49202)
+
+	var list rpc.Message
+	list.Embed(1, serviceMessage("g0", 49202, nil))
+	list.Embed(1, serviceMessage("c0", 49203, nil))
+
+	for _, tc := range []struct {
+		method string
+		req    rpc.Message
+		status string
+		resp   rpc.Message
+	}{
+		{"Lookup", named("c0"), "0", serviceMessage("c0", 49203, nil)},
+		{"Lookup", named("g0"), "5", nil},
+		{"Lookup", nil, "3", nil},
+		{"Alloc", named("g0"), "0", serviceMessage("g0", 49202, nil)},
+		{"Alloc", named("g0"), "6", nil},
+		{"Alloc", named("g1"), "8", nil},
+		{"List", nil, "0", list},
+		{"Forget", port, "0", named("g0")},
+		{"Forget", port, "0", rpc.Message{}},
+		{"Unknown", nil, "12", nil},
+	} {
+		var got []byte
+		status, err := grpcCall(ctx, client, tc.method, tc.req, func(msg []byte) bool {
+			got = msg
+			return true
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status != tc.status || !bytes.Equal(got, tc.resp) {
+			t.Errorf("Call %s(%x) returned %x with status %s instead of %x with %s", tc.method, tc.req, got, status, tc.resp, tc.status)
+		}
+	}
+
+	for _, want := range []string{"alloc", "release"} {
+		select {
+		case msg := <-events:
+			var kind, service string
+			rpc.Decode(msg, func(f rpc.Field) {
+				switch f.Number {
+				case 2:
+					kind = string(f.Bytes)
+				case 3:
+					rpc.Decode(f.Bytes, func(f rpc.Field) {
+						if f.Number == 1 {
+							service = string(f.Bytes)
+						}
+					})
+				}
+			})
+			if kind != want || service != "g0" {
+				t.Errorf("Watched %s of %q instead of %s of g0", kind, service, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("No %s event watched", want)
+		}
+	}
+}
+
+func TestDNS(t *testing.T) {
+
+	testServer(t, Config{DNSListen: "127.0.0.1:0", DNSZone: "test.", DNSTTL: time.Minute}, "c0\t49201\t\n")
+
+	conn, err := net.Dial("udp", dnsSrv.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	for _, tc := range []struct {
+		labels  []string
+		qtype   byte
+		rcode   byte
+		answers byte
+	}{
+		{[]string{"_c0", "_tcp", "test"}, 33, 0, 1},
+		{[]string{"C0", "test"}, 1, 0, 1},
+		{[]string{"c0", "test"}, 28, 0, 1},
+		{[]string{"nope", "test"}, 1, 3, 0},
+	} {
+		query := []byte{0, 1, 1, 0, 0, 1, 0, 0, 0, 0, 0, 0}
+		for _, l := range tc.labels {
+			query = append(append(query, byte(len(l))), l...)
+		}
+		query = append(query, 0, 0, tc.qtype, 0, 1)
+
+		conn.Write(query)
+		resp := make([]byte, 512)
+		n, err := conn.Read(resp)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if n < 12 || resp[3]&0x0f != tc.rcode || resp[7] != tc.answers {
+			t.Errorf("Query %v type %d returned rcode %d with %d answers", tc.labels, tc.qtype, resp[3]&0x0f, resp[7])
+		}
+	}
+}
+
+func TestLine(t *testing.T) {
+
+	socket := filepath.Join(t.TempDir(), "line")
+
+	testServer(t, Config{LineListen: "unix:" + socket}, "")
+
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	replies := bufio.NewReader(conn)
+	read := func() string {
+		reply, err := replies.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		return strings.TrimSuffix(reply, "\n")
+	}
+	send := func(command string) string {
+		fmt.Fprintln(conn, command)
+		return read()
+	}
+
+	if reply := send("GET l0"); reply != `ERR Name "l0" not found in the port registry` {
+		t.Errorf("GET of an unknown service replied %q", reply)
+	}
+
+	port := send("SET l0")
+	if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		t.Fatalf("SET replied %q instead of a port", port)
+	}
+
+	if reply := send("get l0"); reply != port {
+		t.Errorf("GET replied %q instead of %s", reply, port)
+	}
+
+	if reply := send("SET l0"); !strings.HasPrefix(reply, "ERR ") {
+		t.Errorf("SET of a taken name replied %q", reply)
+	}
+
+	found := false
+	for reply := send("LIST"); reply != "END"; reply = read() {
+		found = found || reply == "l0 "+port
+	}
+	if !found {
+		t.Errorf("LIST did not reply with l0 at %s", port)
+	}
+
+	if reply := send("DEL " + port); reply != port {
+		t.Errorf("DEL replied %q instead of %s", reply, port)
+	}
+
+	for _, command := range []string{"GET l0", "DEL x", "DEL", "LIST all", "PUT l0"} {
+		if reply := send(command); !strings.HasPrefix(reply, "ERR ") {
+			t.Errorf("%s replied %q instead of an error", command, reply)
+		}
+	}
+
+	fmt.Fprintln(conn, "QUIT")
+	if _, err := replies.ReadString('\n'); err != io.EOF {
+		t.Errorf("QUIT did not close the connection: %v", err)
+	}
+}
+
+func TestConsul(t *testing.T) {
+
+	url := testServer(t, Config{}, "c0\t49200\t\n")
+
+	query := func(request string, body interface{}) uint64 {
+		resp, err := http.Get(url + request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("Received code %d from %q request", resp.StatusCode, request)
+		}
+		if err = json.NewDecoder(resp.Body).Decode(body); err != nil {
+			t.Fatal(err)
+		}
+
+		index, err := strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64)
+		if err != nil || index == 0 {
+			t.Errorf("Wrong X-Consul-Index %q from %q request", resp.Header.Get("X-Consul-Index"), request)
+		}
+		return index
+	}
+
+	port, _, err := reg.Lookup("c0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var services map[string][]string
+	index := query("/v1/catalog/services", &services)
+	if tags, ok := services["c0"]; !ok || len(tags) != 0 {
+		t.Errorf("Catalog services are %v, missing c0", services)
+	}
+
+	var catalog []consulService
+	query("/v1/catalog/service/c0", &catalog)
+	if len(catalog) != 1 || catalog[0].ServiceName != "c0" || catalog[0].ServicePort != port {
+		t.Errorf("Catalog of c0 is %+v instead of the one at %d", catalog, port)
+	}
+
+	query("/v1/catalog/service/nope", &catalog)
+	if len(catalog) != 0 {
+		t.Errorf("Catalog of an unknown service is %+v", catalog)
+	}
+
+	var health []consulHealth
+	query("/v1/health/service/c0?passing=1", &health)
+	if len(health) != 1 || health[0].Service.Port != port || health[0].Checks[0].Status != "passing" {
+		t.Errorf("Health of c0 is %+v instead of passing at %d", health, port)
+	}
+
+	plain := `pald_request_duration_seconds_count{handler="consul_services"}`
+	blocking := `pald_request_duration_seconds_count{handler="consul_services_blocking"}`
+	plainBefore, blockingBefore := metric(t, url, plain), metric(t, url, blocking)
+
+	start := time.Now()
+	if next := query(fmt.Sprintf("/v1/catalog/services?index=%d&wait=100ms", index), &services); next != index {
+		t.Errorf("Blocking query without changes returned index %d instead of %d", next, index)
+	}
+	if time.Since(start) < 100*time.Millisecond {
+		t.Error("Blocking query without changes returned before the wait time")
+	}
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		publish(registry.Event{Kind: registry.EventAlloc, Entry: registry.Entry{Name: "c9", Port: 1}})
+	}()
+	if next := query(fmt.Sprintf("/v1/catalog/services?index=%d&wait=10s", index), &services); next <= index {
+		t.Errorf("Blocking query with a change returned index %d after %d", next, index)
+	}
+
+	if d := metric(t, url, plain) - plainBefore; d != 0 {
+		t.Errorf("Blocking queries counted %v times as plain requests", d)
+	}
+	if d := metric(t, url, blocking) - blockingBefore; d != 2 {
+		t.Errorf("Blocking queries counted %v times instead of 2", d)
+	}
+}
+
+func TestAudited(t *testing.T) {
+
+	trail, err := audit.Open(filepath.Join(t.TempDir(), "audit"), 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer trail.Close()
+
+	r, _ := registry.New(10, 12)
+	r.SetRangePolicy(registry.RangeMigrate)
+	r.Notify(audited(trail))
+
+	req := httptest.NewRequest("GET", "/set?service=a", nil)
+	req.Header.Set("X-Pald-Client", "tester")
+
+	r.As(origin(req)).Alloc("a")
+	r.As(origin(req)).Import([]registry.Entry{{Name: "a", Port: 10}, {Name: "b", Port: 11}}, registry.ImportMerge)
+	r.SetRange(11, 12)
+	r.As(origin(req)).Forget(11)
+
+	entries, err := trail.Query("", time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for _, e := range entries {
+		got = append(got, fmt.Sprintf("%s %s %d %s %s", e.Event, e.Service, e.Port, e.Caller, e.Client))
+	}
+
+	expected := []string{
+		"alloc a 10 " + req.RemoteAddr + " tester",
+		"import b 11 " + req.RemoteAddr + " tester",
+		"release a 10  pald",
+		"alloc a 12  pald",
+		"release b 11 " + req.RemoteAddr + " tester",
+	}
+
+	if strings.Join(got, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Unexpected audit trail:\n%s\ninstead of:\n%s", strings.Join(got, "\n"), strings.Join(expected, "\n"))
+	}
+}
@@ -0,0 +1,210 @@
+/*
+	(c) Copyright 2015 Vlad Didenko
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	    http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/didenko/pald/internal/registry"
+)
+
+const (
+	// watchBacklog is how many recent events a reconnecting watcher can resume from
+	watchBacklog = 1024
+
+	// watchKeepalive is how often an idle stream gets a comment to keep it open
+	watchKeepalive = 15 * time.Second
+)
+
+// Event is a registry change as streamed by /watch
+type Event struct {
+	ID        string              `json:"id"`
+	Type      string              `json:"type"`
+	Service   string              `json:"service,omitempty"`
+	Port      uint16              `json:"port,omitempty"`
+	Addr      []string            `json:"addr,omitempty"`
+	Watermark *registry.Watermark `json:"watermark,omitempty"`
+	Time      time.Time           `json:"time"`
+
+	seq uint64
+}
+
+// matches tells if the event passes the filter by the service name
+// and the name prefix. The watermark events pass any filter.
+func (ev Event) matches(name, prefix string) bool {
+	return ev.Watermark != nil || (name == "" || ev.Service == name) && strings.HasPrefix(ev.Service, prefix)
+}
+
+// events keeps the recent registry changes for the watchers. The
+// resume tokens are the event IDs, made of the epoch, unique to the
+// process, and the sequence number of the event.
+var events = struct {
+	sync.Mutex
+	epoch  string
+	seq    uint64
+	recent []Event
+	wake   chan struct{}
+}{
+	epoch: strconv.FormatInt(time.Now().UnixNano(), 36),
+	wake:  make(chan struct{}),
+}
+
+// publish is the registry change hook feeding the watchers
+func publish(ev registry.Event) {
+
+	events.Lock()
+	defer events.Unlock()
+
+	events.seq++
+
+	events.recent = append(events.recent, Event{
+		ID:        fmt.Sprintf("%s-%d", events.epoch, events.seq),
+		Type:      string(ev.Kind),
+		Service:   ev.Name,
+		Port:      ev.Port,
+		Addr:      ev.Addr,
+		Watermark: ev.Watermark,
+		Time:      time.Now().UTC(),
+		seq:       events.seq,
+	})
+
+	if len(events.recent) > watchBacklog {
+		events.recent = events.recent[len(events.recent)-watchBacklog:]
+	}
+
+	close(events.wake)
+	events.wake = make(chan struct{})
+}
+
+// since returns the events after the resume token, and a channel
+// closed on the next event. It fails if the token is not from this
+// process or the events after it are no longer kept.
+func since(token string) ([]Event, <-chan struct{}, error) {
+
+	events.Lock()
+	defer events.Unlock()
+
+	i := strings.LastIndexByte(token, '-')
+	if i < 0 || token[:i] != events.epoch {
+		return nil, events.wake, fmt.Errorf("Resume token %q is not known", token)
+	}
+
+	last, err := strconv.ParseUint(token[i+1:], 10, 64)
+	if err != nil || last > events.seq {
+		return nil, events.wake, fmt.Errorf("Resume token %q is not known", token)
+	}
+
+	if oldest := events.seq - uint64(len(events.recent)); last < oldest {
+		return nil, events.wake, fmt.Errorf("Events after resume token %q are no longer kept", token)
+	}
+
+	first := len(events.recent) - int(events.seq-last)
+
+	return append([]Event(nil), events.recent[first:]...), events.wake, nil
+}
+
+// latest returns the ID of the last event, or of the process start
+func latest() string {
+	events.Lock()
+	defer events.Unlock()
+	return fmt.Sprintf("%s-%d", events.epoch, events.seq)
+}
+
+// changes returns the sequence number of the last event
+// and a channel closed on the next event
+func changes() (uint64, <-chan struct{}) {
+	events.Lock()
+	defer events.Unlock()
+	return events.seq, events.wake
+}
+
+// watch streams the registry changes as Server-Sent Events, optionally
+// only of the named service or of the services with a name prefix.
+// A client resumes after the last event it got by sending its ID in
+// the Last-Event-ID header or the since parameter. If the events after
+// it are lost, the stream starts with a reset event, after which the
+// client should fetch the registry anew, e.g. from /export.
+func watch(w http.ResponseWriter, r *http.Request) {
+
+	cacheOff(w)
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	name := r.Form.Get("service")
+	prefix := r.Form.Get("prefix")
+
+	token := r.Header.Get("Last-Event-ID")
+	if token == "" {
+		token = r.Form.Get("since")
+	}
+	if token == "" {
+		token = latest()
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.WriteHeader(http.StatusOK)
+
+	keepalive := time.NewTicker(watchKeepalive)
+	defer keepalive.Stop()
+
+	pending, wake, err := since(token)
+
+	for {
+		if err != nil {
+			token = latest()
+			pending, wake, _ = since(token)
+			reason, _ := json.Marshal(err.Error())
+			fmt.Fprintf(w, "id: %s\nevent: reset\ndata: %s\n\n", token, reason)
+		}
+
+		for _, ev := range pending {
+			token = ev.ID
+			if !ev.matches(name, prefix) {
+				continue
+			}
+			data, _ := json.Marshal(ev)
+			fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", ev.ID, ev.Type, data)
+		}
+		flusher.Flush()
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepalive.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+		case <-wake:
+		}
+
+		pending, wake, err = since(token)
+	}
+}
@@ -0,0 +1,289 @@
+/*
+	(c) Copyright 2015 Vlad Didenko
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	    http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+// Package webhook delivers registry events to HTTP receivers as
+// JSON POST requests, in the background and with retries.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/didenko/pald/internal/registry"
+)
+
+// Target is a receiver of the events. Empty filters pass all events.
+type Target struct {
+	URL    string   `mapstructure:"url"`
+	Events []string `mapstructure:"events"`
+	Prefix string   `mapstructure:"prefix"`
+}
+
+// Validate checks the URL and the event filter of the target
+func (t Target) Validate() error {
+
+	u, err := url.Parse(t.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return fmt.Errorf("Webhook URL %q is not an HTTP URL", t.URL)
+	}
+
+	for _, e := range t.Events {
+		switch registry.EventKind(e) {
+		case registry.EventAlloc, registry.EventRelease, registry.EventWatermark:
+		default:
+			return fmt.Errorf("Webhook %q filters an unknown event %q", t.URL, e)
+		}
+	}
+
+	return nil
+}
+
+// Options tune the delivery. Zero values take the defaults,
+// except for Retries, where zero disables retrying.
+type Options struct {
+	// Queue is how many events per target wait for delivery
+	// before new ones are dropped, 100 by default
+	Queue int
+
+	// Retries is how many times a failed delivery is retried,
+	// 5 if negative
+	Retries int
+
+	// Backoff is the delay before the first retry, doubled for every
+	// next one up to a minute, 1 second by default
+	Backoff time.Duration
+
+	// Timeout limits a single delivery attempt, 10 seconds by default
+	Timeout time.Duration
+}
+
+// Payload is the JSON body of the requests
+type Payload struct {
+	Event     string              `json:"event"`
+	Service   string              `json:"service,omitempty"`
+	Port      uint16              `json:"port,omitempty"`
+	Addr      []string            `json:"addr,omitempty"`
+	Watermark *registry.Watermark `json:"watermark,omitempty"`
+	Time      time.Time           `json:"time"`
+}
+
+const maxBackoff = time.Minute
+
+// Dispatcher queues the events per target and delivers them
+type Dispatcher struct {
+	opts    Options
+	client  *http.Client
+	targets []*target
+	ctx     context.Context
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+
+	// Dropped counts events dropped because of a full queue
+	// or exhausted retries
+	Dropped atomic.Int64
+}
+
+type target struct {
+	Target
+	queue chan Payload
+}
+
+// New starts delivering to the targets. It fails on invalid
+// target URLs or unknown events in the filters.
+func New(targets []Target, opts Options) (*Dispatcher, error) {
+
+	if opts.Queue <= 0 {
+		opts.Queue = 100
+	}
+	if opts.Retries < 0 {
+		opts.Retries = 5
+	}
+	if opts.Backoff <= 0 {
+		opts.Backoff = time.Second
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = 10 * time.Second
+	}
+
+	d := &Dispatcher{
+		opts:   opts,
+		client: &http.Client{Timeout: opts.Timeout},
+	}
+
+	for _, t := range targets {
+
+		if err := t.Validate(); err != nil {
+			return nil, err
+		}
+
+		d.targets = append(d.targets, &target{t, make(chan Payload, opts.Queue)})
+	}
+
+	d.ctx, d.cancel = context.WithCancel(context.Background())
+
+	for _, t := range d.targets {
+		d.wg.Add(1)
+		go d.deliver(t)
+	}
+
+	return d, nil
+}
+
+// Send queues the event for the targets whose filters pass it.
+// It never blocks: if a target's queue is full, the event is
+// dropped for that target. Send fits registry.Notify.
+func (d *Dispatcher) Send(ev registry.Event) {
+
+	p := Payload{
+		Event:     string(ev.Kind),
+		Service:   ev.Name,
+		Port:      ev.Port,
+		Addr:      ev.Addr,
+		Watermark: ev.Watermark,
+		Time:      time.Now().UTC(),
+	}
+
+	for _, t := range d.targets {
+
+		if !t.passes(p) {
+			continue
+		}
+
+		select {
+		case t.queue <- p:
+		default:
+			d.Dropped.Add(1)
+			slog.Warn("Webhook queue is full, event dropped", "url", t.URL, "event", p.Event, "service", p.Service)
+		}
+	}
+}
+
+// Close stops the deliveries. Queued events are dropped.
+func (d *Dispatcher) Close() {
+	d.cancel()
+	d.wg.Wait()
+}
+
+func (t *target) passes(p Payload) bool {
+
+	// Watermarks concern the whole range, not some services
+	if p.Watermark == nil && !strings.HasPrefix(p.Service, t.Prefix) {
+		return false
+	}
+
+	if len(t.Events) == 0 {
+		return true
+	}
+
+	for _, e := range t.Events {
+		if e == p.Event {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (d *Dispatcher) deliver(t *target) {
+
+	defer d.wg.Done()
+
+	for {
+		select {
+		case <-d.ctx.Done():
+			return
+		case p := <-t.queue:
+			if !d.post(t, p) {
+				d.Dropped.Add(1)
+			}
+		}
+	}
+}
+
+// post sends the payload, retrying with an exponential backoff,
+// and reports if it was delivered
+func (d *Dispatcher) post(t *target, p Payload) bool {
+
+	body, err := json.Marshal(p)
+	if err != nil {
+		slog.Error("Webhook payload failed to encode", "err", err)
+		return false
+	}
+
+	backoff := d.opts.Backoff
+
+	for attempt := 0; ; attempt++ {
+
+		retry, err := d.attempt(t.URL, p.Event, body)
+		if err == nil {
+			return true
+		}
+
+		if !retry || attempt >= d.opts.Retries {
+			slog.Error("Webhook delivery failed", "url", t.URL, "event", p.Event, "service", p.Service, "attempts", attempt+1, "err", err)
+			return false
+		}
+
+		slog.Debug("Webhook delivery failed, retrying", "url", t.URL, "in", backoff, "err", err)
+
+		select {
+		case <-d.ctx.Done():
+			return false
+		case <-time.After(backoff):
+		}
+
+		if backoff *= 2; backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// attempt makes a single delivery and reports if a failure is worth retrying
+func (d *Dispatcher) attempt(to, event string, body []byte) (bool, error) {
+
+	req, err := http.NewRequestWithContext(d.ctx, "POST", to, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "pald")
+	req.Header.Set("X-Pald-Event", event)
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode >= 500, resp.StatusCode == http.StatusTooManyRequests:
+		return true, fmt.Errorf("Receiver responded %s", resp.Status)
+	default:
+		return false, fmt.Errorf("Receiver responded %s", resp.Status)
+	}
+}
@@ -0,0 +1,213 @@
+/*
+	(c) Copyright 2015 Vlad Didenko
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	    http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package webhook
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/didenko/pald/internal/registry"
+)
+
+func event(kind registry.EventKind, name string, port uint16) registry.Event {
+	return registry.Event{Kind: kind, Entry: registry.Entry{Name: name, Port: port}}
+}
+
+// receiver collects the payloads of successful deliveries
+// after failing the given number of requests
+type receiver struct {
+	sync.Mutex
+	fail     int
+	requests int
+	got      []Payload
+	arrived  chan struct{}
+}
+
+func (rc *receiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	rc.Lock()
+	defer rc.Unlock()
+
+	rc.requests++
+	if rc.requests <= rc.fail {
+		http.Error(w, "busy", http.StatusServiceUnavailable)
+		return
+	}
+
+	var p Payload
+	json.NewDecoder(r.Body).Decode(&p)
+
+	if r.Header.Get("X-Pald-Event") != p.Event {
+		http.Error(w, "event header mismatch", http.StatusBadRequest)
+		return
+	}
+
+	rc.got = append(rc.got, p)
+	rc.arrived <- struct{}{}
+}
+
+func (rc *receiver) wait(t *testing.T, n int) []string {
+	for i := 0; i < n; i++ {
+		select {
+		case <-rc.arrived:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Only %d of %d deliveries arrived", i, n)
+		}
+	}
+
+	rc.Lock()
+	defer rc.Unlock()
+
+	got := make([]string, 0, len(rc.got))
+	for _, p := range rc.got {
+		got = append(got, p.Event+" "+p.Service)
+	}
+	sort.Strings(got)
+	return got
+}
+
+func TestRetry(t *testing.T) {
+
+	rc := &receiver{fail: 2, arrived: make(chan struct{}, 10)}
+	srv := httptest.NewServer(rc)
+	defer srv.Close()
+
+	d, err := New([]Target{{URL: srv.URL}}, Options{Retries: -1, Backoff: time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	d.Send(event(registry.EventAlloc, "web", 49201))
+
+	rc.wait(t, 1)
+
+	rc.Lock()
+	defer rc.Unlock()
+
+	if rc.requests != 3 {
+		t.Errorf("Expected 3 attempts, got %d", rc.requests)
+	}
+	if p := rc.got[0]; p.Service != "web" || p.Port != 49201 || p.Time.IsZero() {
+		t.Errorf("Unexpected payload %+v", p)
+	}
+}
+
+func TestGiveUp(t *testing.T) {
+
+	for _, retries := range []int{2, 0} {
+
+		rc := &receiver{fail: 100, arrived: make(chan struct{}, 10)}
+		srv := httptest.NewServer(rc)
+
+		d, err := New([]Target{{URL: srv.URL}}, Options{Retries: retries, Backoff: time.Millisecond})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		d.Send(event(registry.EventAlloc, "web", 49201))
+
+		for i := 0; i < 100 && d.Dropped.Load() == 0; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		d.Close()
+		srv.Close()
+
+		rc.Lock()
+		if d.Dropped.Load() != 1 || rc.requests != retries+1 {
+			t.Errorf("Expected %d attempts and a drop, got %d attempts and %d drops", retries+1, rc.requests, d.Dropped.Load())
+		}
+		rc.Unlock()
+	}
+}
+
+func TestFilter(t *testing.T) {
+
+	releases := &receiver{arrived: make(chan struct{}, 10)}
+	webs := &receiver{arrived: make(chan struct{}, 10)}
+
+	srvReleases := httptest.NewServer(releases)
+	defer srvReleases.Close()
+	srvWebs := httptest.NewServer(webs)
+	defer srvWebs.Close()
+
+	d, err := New([]Target{
+		{URL: srvReleases.URL, Events: []string{"release"}},
+		{URL: srvWebs.URL, Prefix: "web-"},
+	}, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	d.Send(event(registry.EventAlloc, "web-a", 49201))
+	d.Send(event(registry.EventRelease, "db", 49202))
+	d.Send(event(registry.EventRelease, "web-b", 49203))
+
+	if got := strings.Join(releases.wait(t, 2), ", "); got != "release db, release web-b" {
+		t.Errorf("The release filter passed %s", got)
+	}
+	if got := strings.Join(webs.wait(t, 2), ", "); got != "alloc web-a, release web-b" {
+		t.Errorf("The prefix filter passed %s", got)
+	}
+}
+
+func TestQueueFull(t *testing.T) {
+
+	unblock := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-unblock
+	}))
+	defer srv.Close()
+	defer close(unblock)
+
+	d, err := New([]Target{{URL: srv.URL}}, Options{Queue: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		d.Send(event(registry.EventAlloc, "web", 49201))
+	}
+
+	if time.Since(start) > time.Second {
+		t.Error("Send blocked on a slow receiver")
+	}
+	if d.Dropped.Load() == 0 {
+		t.Error("Events over the queue size should be dropped")
+	}
+}
+
+func TestInvalid(t *testing.T) {
+
+	for _, target := range []Target{
+		{URL: "localhost:8080/hook"},
+		{URL: "http://localhost/hook", Events: []string{"expire"}},
+	} {
+		if _, err := New([]Target{target}, Options{}); err == nil {
+			t.Errorf("Target %+v should be rejected", target)
+		}
+	}
+}
@@ -17,13 +17,26 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"fmt"
-	"log"
+	"log/slog"
 	"os"
 	"path"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/didenko/pald/internal/audit"
+	"github.com/didenko/pald/internal/hook"
+	"github.com/didenko/pald/internal/lock"
+	"github.com/didenko/pald/internal/logging"
+	"github.com/didenko/pald/internal/persist"
 	"github.com/didenko/pald/internal/platform"
+	"github.com/didenko/pald/internal/registry"
 	"github.com/didenko/pald/internal/server"
+	"github.com/didenko/pald/internal/webhook"
 	"github.com/didenko/viper"
 	"github.com/takama/daemon"
 )
@@ -34,28 +47,62 @@ const (
 )
 
 var (
-	stdlog *log.Logger
-	errlog *log.Logger
-
 	portMin uint16
 	portMax uint16
 	portSvr uint16
 
 	dumpName string
+	kvName   string
+	storage  string
+
+	loadPolicy  registry.LoadPolicy
+	rangePolicy registry.RangePolicy
+
+	configWatch time.Duration
+	accessLog   bool
+	grpcListen  string
+	lineListen  string
+
+	dnsListen string
+	dnsZone   string
+	dnsTTL    time.Duration
+
+	readyFailExhausted bool
+	watermarks         []int
+
+	webhookTargets []webhook.Target
+	webhookOptions webhook.Options
+	webhooks       *webhook.Dispatcher
+
+	hookCommands hook.Commands
+	hooks        *hook.Runner
+
+	auditName    string
+	auditMaxSize int64
+	auditKeep    int
+	auditLog     *audit.Log
 
 	platformConfig platform.Config
+
+	// configFlag is the config file given by --config or PALD_CONFIG,
+	// and configFile is the config file in use, if any
+	configFlag string
+	configFile string
+
+	// flagged maps the keys set by the command line flags to the flags
+	flagged map[string]string
 )
 
 type Service struct {
 	daemon.Daemon
 }
 
-func (service *Service) Manage() (string, error) {
-	usage := fmt.Sprintf("Usage: %s install | remove | start | stop | status", daemonName)
+func (service *Service) Manage(args []string) (string, error) {
+	usage := fmt.Sprintf("Usage: %s [flags] install | remove | start | stop | status | fsck [--fix] | export | import | get | set | del | list | exec | render | config check | config show", daemonName)
 
 	// if received any kind of command, do it
-	if len(os.Args) > 1 {
-		command := os.Args[1]
+	if len(args) > 0 {
+		command := args[0]
 		switch command {
 		case "install":
 			return service.Install()
@@ -66,68 +113,307 @@ func (service *Service) Manage() (string, error) {
 		case "stop":
 			return service.Stop()
 		case "status":
-			return service.Status()
+			return status(service)
+		case "fsck":
+			return fsck(args[1:])
+		case "export":
+			return exportSnapshot(args[1:])
+		case "import":
+			return importSnapshot(args[1:])
+		case "get", "set", "del", "list":
+			return clientCommand(command, args[1:])
+		case "exec":
+			return execCommand(args[1:])
+		case "render":
+			return renderCommand(args[1:])
 		default:
 			return usage, nil
 		}
 	}
 
-	log.Println("Server listens on port: ", portSvr)
-	log.Println("First port for allocation: ", portMin)
-	log.Println("Last  port for allocation: ", portMax)
-	log.Println("Dump file: ", dumpName)
+	slog.Info("Starting",
+		"listen", portSvr,
+		"port_min", portMin,
+		"port_max", portMax,
+		"storage", storage,
+		"location", storeName())
+
+	guard, err := lockStorage()
+	if err != nil {
+		return "Another instance seems to be running", err
+	}
+
+	store, err := persist.Open(storage, storeName())
+	if err != nil {
+		guard.Release()
+		return "Failed to open the registry storage", err
+	}
+
+	// A reload may switch the storage, so the one held at exit is closed
+	held := &holding{guard: guard, store: store}
+	defer held.release()
+
+	if auditName != "" {
+		auditLog, err = audit.Open(auditName, auditMaxSize, auditKeep)
+		if err != nil {
+			return "Failed to open the audit trail", err
+		}
+		defer auditLog.Close()
+	}
+
+	if len(webhookTargets) > 0 {
+		webhooks, err = webhook.New(webhookTargets, webhookOptions)
+		if err != nil {
+			return "Failed to set up the webhooks", err
+		}
+		defer webhooks.Close()
+	}
+
+	hooks = hook.New(hookCommands)
+	defer hooks.Close()
 
-	server.Run(portSvr, portMin, portMax, dumpName)
-	// never happen, but need to complete code
-	return usage, nil
+	go watchReload(held)
+
+	return "Server failed", server.Run(serverConfig(store))
 }
 
-func downcast(i int, name string) uint16 {
-	if i < 0 || i > 65535 {
-		panic(fmt.Sprintf("Variable %s = %d is not convertible to uint16", name, i))
+// serverConfig collects the server settings from the configuration
+func serverConfig(store persist.Backend) server.Config {
+
+	throttle := time.Second
+	if storage == "kv" {
+		throttle = 0
+	}
+
+	return server.Config{
+		Listen:   portSvr,
+		PortMin:  portMin,
+		PortMax:  portMax,
+		Store:    store,
+		Throttle: throttle,
+		Policy:   loadPolicy,
+		Ranging:  rangePolicy,
+
+		GRPCListen: grpcListen,
+		LineListen: lineListen,
+		DNSListen:  dnsListen,
+		DNSZone:    dnsZone,
+		DNSTTL:     dnsTTL,
+
+		AccessLog: accessLog,
+		Audit:     auditLog,
+
+		ReadyFailExhausted: readyFailExhausted,
+		Watermarks:         watermarks,
+		Webhooks:           webhooks,
+		Hooks:              hooks,
 	}
-	return uint16(i)
 }
 
-func init() {
+// storeName returns the location of the configured storage
+func storeName() string {
+	if storage == "kv" {
+		return kvName
+	}
+	return dumpName
+}
 
-	platformConfig = platform.GetConfig()
+// lockName returns the location of the PID file guarding the storage
+func lockName() string {
+	return storeName() + ".lock"
+}
+
+// lockWait limits waiting for the storage lock, which the commands
+// working without the daemon only hold for a moment
+const lockWait = 2 * time.Second
+
+// lockStorage takes the lock guarding the configured storage
+func lockStorage() (*lock.Lock, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), lockWait)
+	defer cancel()
+	return lock.Wait(ctx, lockName())
+}
+
+// flagKeys are the config keys the command line flags override
+var flagKeys = map[string]string{
+	"port-min":  "port_min",
+	"port-max":  "port_max",
+	"listen":    "port_listen",
+	"dump-file": "dump_file",
+}
 
-	viper.AddConfigPath(platformConfig.DirSystem())
-	viper.AddConfigPath(platformConfig.DirUser())
-	viper.SetConfigName("config")
+// configure sets up reading the configuration and returns the
+// arguments left after the flags. The settings are taken from, in the increasing
+// order of precedence, the defaults, the config file, the PALD_*
+// environment variables and the command line flags.
+func configure(args []string) ([]string, error) {
+
+	flags := flag.NewFlagSet(daemonName, flag.ContinueOnError)
+	flags.String("config", os.Getenv("PALD_CONFIG"), "the config file to use instead of searching for one")
+	flags.Int("port-min", 0, "the lowest port to allocate")
+	flags.Int("port-max", 0, "the highest port to allocate")
+	flags.Int("listen", 0, "the port to serve the HTTP interface at")
+	flags.String("dump-file", "", "the file to keep the registry in")
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	}
+
+	platformConfig = platform.GetConfig()
+	configFlag = flags.Lookup("config").Value.String()
 
 	viper.SetDefault("port_min", 49201)
 	viper.SetDefault("port_max", 49999)
 	viper.SetDefault("port_listen", 49200)
+	viper.SetDefault("grpc_listen", "")
+	viper.SetDefault("line_listen", "")
+	viper.SetDefault("dns_listen", "")
+	viper.SetDefault("dns_zone", "pald")
+	viper.SetDefault("dns_ttl", "5s")
 	viper.SetDefault("dump_file", path.Join(platformConfig.DirUser(), "dump"))
+	viper.SetDefault("kv_file", path.Join(platformConfig.DirUser(), "registry.db"))
+	viper.SetDefault("storage", "file")
+	viper.SetDefault("load_policy", "orphan")
+	viper.SetDefault("range_policy", "keep")
+	viper.SetDefault("config_watch", 0)
+	viper.SetDefault("log_format", "logfmt")
+	viper.SetDefault("log_level", "info")
+	viper.SetDefault("log_file", "stderr")
+	viper.SetDefault("access_log", false)
+	viper.SetDefault("audit_file", path.Join(platformConfig.DirUser(), "audit.log"))
+	viper.SetDefault("audit_max_size", 1<<20)
+	viper.SetDefault("audit_keep", 5)
+	viper.SetDefault("ready_fail_exhausted", true)
+	viper.SetDefault("watermarks", []string{"80", "95"})
+	viper.SetDefault("webhook_queue", 100)
+	viper.SetDefault("webhook_retries", 5)
+	viper.SetDefault("webhook_timeout", "10s")
+	viper.SetDefault("hook_timeout", "10s")
 
-	err := viper.ReadInConfig()
-	if err != nil {
-		panic(err)
+	viper.SetEnvPrefix(daemonName)
+	viper.AutomaticEnv()
+
+	flagged = make(map[string]string)
+	flags.Visit(func(f *flag.Flag) {
+		if key, ok := flagKeys[f.Name]; ok {
+			viper.Set(key, f.Value.(flag.Getter).Get())
+			flagged[key] = "--" + f.Name
+		}
+	})
+
+	return flags.Args(), nil
+}
+
+// readConfig reads the configuration file, if any, and sets the
+// package variables from the settings if they are all valid
+func readConfig() error {
+
+	if err := readConfigFile(); err != nil {
+		return err
+	}
+
+	if problems := checkConfig(); len(problems) > 0 {
+		return errors.New(strings.Join(problems, "; "))
 	}
 
-	portMin = downcast(viper.GetInt("port_min"), "port_min")
-	portMax = downcast(viper.GetInt("port_max"), "port_max")
-	portSvr = downcast(viper.GetInt("port_listen"), "port_listen")
+	portMin = uint16(viper.GetInt("port_min"))
+	portMax = uint16(viper.GetInt("port_max"))
+	portSvr = uint16(viper.GetInt("port_listen"))
 
 	dumpName = viper.GetString("dump_file")
+	kvName = viper.GetString("kv_file")
+	storage = viper.GetString("storage")
+
+	loadPolicy, _ = registry.ParseLoadPolicy(viper.GetString("load_policy"))
+	rangePolicy, _ = registry.ParseRangePolicy(viper.GetString("range_policy"))
+
+	configWatch = viper.GetDuration("config_watch")
+	accessLog = viper.GetBool("access_log")
+	grpcListen = viper.GetString("grpc_listen")
+	lineListen = viper.GetString("line_listen")
+
+	dnsListen = viper.GetString("dns_listen")
+	dnsZone = viper.GetString("dns_zone")
+	dnsTTL = viper.GetDuration("dns_ttl")
+
+	auditName = viper.GetString("audit_file")
+	auditMaxSize = int64(viper.GetInt("audit_max_size"))
+	auditKeep = viper.GetInt("audit_keep")
+
+	readyFailExhausted = viper.GetBool("ready_fail_exhausted")
+
+	watermarks = nil
+	for _, wm := range watermarkSettings() {
+		percent, _ := strconv.Atoi(wm)
+		watermarks = append(watermarks, percent)
+	}
+
+	webhookTargets = nil
+	viper.MarshalKey("webhooks", &webhookTargets)
+
+	webhookOptions = webhook.Options{
+		Queue:   viper.GetInt("webhook_queue"),
+		Retries: viper.GetInt("webhook_retries"),
+		Timeout: viper.GetDuration("webhook_timeout"),
+	}
 
-	stdlog = log.New(os.Stdout, "", log.Ldate|log.Ltime)
-	errlog = log.New(os.Stderr, "", log.Ldate|log.Ltime)
+	hookCommands = hook.Commands{
+		PreAlloc:    viper.GetStringSlice("hook_pre_alloc"),
+		PostAlloc:   viper.GetStringSlice("hook_post_alloc"),
+		PreRelease:  viper.GetStringSlice("hook_pre_release"),
+		PostRelease: viper.GetStringSlice("hook_post_release"),
+		Timeout:     viper.GetDuration("hook_timeout"),
+	}
+
+	return logging.Setup(
+		viper.GetString("log_format"),
+		viper.GetString("log_level"),
+		viper.GetString("log_file"))
 }
 
 func main() {
-	srv, err := daemon.New(daemonName, daemonDesc)
+	args, err := configure(os.Args[1:])
+	if err == flag.ErrHelp {
+		os.Exit(0)
+	}
 	if err != nil {
-		errlog.Println("Error: ", err)
+		fmt.Fprintln(os.Stderr, "Error:", err)
 		os.Exit(1)
 	}
-	service := &Service{srv}
-	status, err := service.Manage()
+
+	var status string
+	if len(args) > 0 && args[0] == "config" {
+		status, err = configCommand(args[1:])
+	} else {
+		status, err = manage(args)
+	}
+
 	if err != nil {
-		errlog.Println(status, "\nError: ", err)
+		fmt.Fprintln(os.Stderr, status)
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		var exit *exitError
+		if errors.As(err, &exit) {
+			os.Exit(exit.code)
+		}
 		os.Exit(1)
 	}
-	fmt.Println(status)
+	if status != "" {
+		fmt.Println(status)
+	}
+}
+
+// manage reads the configuration and runs the command
+// or, if there is none, the daemon
+func manage(args []string) (string, error) {
+
+	if err := readConfig(); err != nil {
+		return "Invalid configuration, see " + daemonName + " config check", err
+	}
+
+	srv, err := daemon.New(daemonName, daemonDesc)
+	if err != nil {
+		return "Failed to set up the service", err
+	}
+
+	service := &Service{srv}
+	return service.Manage(args)
 }
@@ -0,0 +1,133 @@
+/*
+	(c) Copyright 2015 Vlad Didenko
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	    http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/didenko/pald/internal/lock"
+	"github.com/didenko/pald/internal/persist"
+	"github.com/didenko/pald/internal/server"
+)
+
+// holding is the storage in use by the running server and its lock
+type holding struct {
+	sync.Mutex
+	guard *lock.Lock
+	store persist.Backend
+}
+
+// release closes the storage held and releases its lock
+func (h *holding) release() {
+	h.Lock()
+	defer h.Unlock()
+	h.store.Close()
+	h.guard.Release()
+}
+
+// watchReload reloads the configuration on SIGHUP and, if the
+// config_watch interval is set, when the config file changes
+func watchReload(h *holding) {
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	var tick <-chan time.Time
+	if configWatch > 0 {
+		tick = time.Tick(configWatch)
+	}
+
+	stamp := configStamp()
+
+	for {
+		select {
+		case <-hup:
+			slog.Info("Reload requested by SIGHUP")
+		case <-tick:
+			if s := configStamp(); s.Equal(stamp) {
+				continue
+			}
+			slog.Info("Reload requested by a config file change")
+		}
+
+		stamp = configStamp()
+
+		if err := h.reload(); err != nil {
+			slog.Error("Reload failed", "err", err)
+		}
+	}
+}
+
+// configStamp returns the modification time of the config file in use
+func configStamp() time.Time {
+	info, err := os.Stat(configFile)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
+
+// reload re-reads the configuration and applies it to the running
+// server. When the storage location changes, the new storage gets
+// locked and opened before the switch and the unused one is released.
+func (h *holding) reload() error {
+
+	h.Lock()
+	defer h.Unlock()
+
+	oldName := storeName()
+
+	err := readConfig()
+	if err != nil {
+		return fmt.Errorf("failed to read the configuration: %s", err)
+	}
+
+	if storeName() == oldName {
+		_, err = server.Reload(serverConfig(h.store))
+		return err
+	}
+
+	guard, err := lockStorage()
+	if err != nil {
+		return fmt.Errorf("failed to lock the new storage: %s", err)
+	}
+
+	store, err := persist.Open(storage, storeName())
+	if err != nil {
+		guard.Release()
+		return fmt.Errorf("failed to open the new storage: %s", err)
+	}
+
+	current, err := server.Reload(serverConfig(store))
+
+	if current.Store == store {
+		h.store.Close()
+		h.guard.Release()
+		h.store, h.guard = store, guard
+	} else {
+		store.Close()
+		guard.Release()
+	}
+
+	return err
+}
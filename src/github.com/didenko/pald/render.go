@@ -0,0 +1,269 @@
+/*
+	(c) Copyright 2015 Vlad Didenko
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	    http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"text/template"
+	"time"
+
+	"github.com/didenko/pald/client"
+)
+
+// renderData is what the templates are executed against
+type renderData struct {
+	Services []client.Entry
+}
+
+// Port returns the port of the named service, failing
+// the rendering if the service is not registered
+func (d renderData) Port(name string) (uint16, error) {
+	e, err := d.Service(name)
+	return e.Port, err
+}
+
+// Service returns the named service, failing the
+// rendering if it is not registered
+func (d renderData) Service(name string) (client.Entry, error) {
+	for _, e := range d.Services {
+		if e.Name == name {
+			return e, nil
+		}
+	}
+	return client.Entry{}, fmt.Errorf("Service %q is not registered", name)
+}
+
+// renderRetry is how soon a failed render is tried again in the watch mode
+const renderRetry = 10 * time.Second
+
+// renderer renders a template into a file
+type renderer struct {
+	client *client.Client
+	tmpl   *template.Template
+	out    string
+	reload string
+
+	// unreloaded is set while the output is written
+	// but the reload command has not succeeded yet
+	unreloaded bool
+}
+
+// renderCommand renders a template against the registry of the
+// running daemon, and in the watch mode keeps re-rendering it
+// on changes until interrupted
+func renderCommand(args []string) (string, error) {
+
+	usage := "Usage: " + daemonName + " render -t template [-o output] [--watch] [--reload command]"
+
+	flags := flag.NewFlagSet("render", flag.ContinueOnError)
+	tmplName := flags.String("t", "", "the text/template file to render")
+	out := flags.String("o", "-", "the file to write, the stdout by default")
+	watch := flags.Bool("watch", false, "re-render on registry changes until interrupted")
+	reload := flags.String("reload", "", "a shell command to run after the output changes")
+	if err := flags.Parse(args); err != nil {
+		return usage, err
+	}
+
+	if *tmplName == "" || flags.NArg() > 0 {
+		return usage, errors.New("A template is required")
+	}
+	if *watch && *out == "-" {
+		return usage, errors.New("The watch mode needs an output file")
+	}
+
+	tmpl, err := template.New(filepath.Base(*tmplName)).Option("missingkey=error").ParseFiles(*tmplName)
+	if err != nil {
+		return "Failed to parse the template", err
+	}
+
+	r := &renderer{client: newClient("render"), tmpl: tmpl, out: *out, reload: *reload}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	if err = r.render(ctx); err != nil {
+		return "Failed to render the template", exitCode(err)
+	}
+
+	if *watch {
+		r.watch(ctx)
+	}
+
+	return "", nil
+}
+
+// render writes the output if it changed and then runs the reload
+// command, also if the output is the same but failed to reload before
+func (r *renderer) render(ctx context.Context) error {
+
+	list, err := r.client.List(ctx)
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	if err = r.tmpl.Execute(&buf, renderData{list}); err != nil {
+		return err
+	}
+
+	if r.out == "-" {
+		_, err = os.Stdout.Write(buf.Bytes())
+		return err
+	}
+
+	if old, err := ioutil.ReadFile(r.out); err != nil || !bytes.Equal(old, buf.Bytes()) {
+
+		if err = writeAtomic(r.out, buf.Bytes()); err != nil {
+			return err
+		}
+
+		slog.Info("Rendered", "output", r.out, "services", len(list))
+		r.unreloaded = true
+	}
+
+	if r.reload == "" || !r.unreloaded {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, "sh", "-c", r.reload)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+
+	if err = cmd.Run(); err != nil {
+		return fmt.Errorf("Reload command failed: %s", err)
+	}
+
+	r.unreloaded = false
+	return nil
+}
+
+// watch re-renders after registry changes, reconnecting to the
+// daemon with a backoff until the context is done. It also renders
+// once the stream is open, not to miss the changes made before,
+// and tries a failed render again after a while.
+func (r *renderer) watch(ctx context.Context) {
+
+	changed := make(chan struct{}, 1)
+
+	notify := func() {
+		select {
+		case changed <- struct{}{}:
+		default:
+		}
+	}
+
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-changed:
+			}
+
+			// Let a burst of changes settle
+			time.Sleep(200 * time.Millisecond)
+			select {
+			case <-changed:
+			default:
+			}
+
+			if err := r.render(ctx); err != nil && ctx.Err() == nil {
+				slog.Error("Failed to render the template, retrying", "in", renderRetry, "err", err)
+				time.AfterFunc(renderRetry, notify)
+			}
+		}
+	}()
+
+	var (
+		last    string
+		backoff = time.Second
+	)
+
+	for ctx.Err() == nil {
+
+		connected := time.Now()
+
+		err := r.client.WatchOpened(ctx, last, notify, func(ev client.Event) {
+			last = ev.ID
+			backoff = time.Second
+			if ev.Type != "watermark" {
+				notify()
+			}
+		})
+
+		if ctx.Err() != nil {
+			return
+		}
+
+		slog.Warn("Lost the daemon watch stream, reconnecting", "in", backoff, "err", err)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+
+		if time.Since(connected) < time.Minute && backoff < 30*time.Second {
+			backoff *= 2
+		}
+	}
+}
+
+// writeAtomic replaces the file with the data, so that readers
+// see either the old or the new content
+func writeAtomic(name string, data []byte) error {
+
+	tmp, err := ioutil.TempFile(filepath.Dir(name), "."+filepath.Base(name)+".")
+	if err != nil {
+		return err
+	}
+
+	mode := os.FileMode(0644)
+	if info, err := os.Stat(name); err == nil {
+		mode = info.Mode()
+	}
+
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Chmod(mode)
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), name)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+
+	return err
+}
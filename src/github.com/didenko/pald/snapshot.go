@@ -0,0 +1,110 @@
+/*
+	(c) Copyright 2015 Vlad Didenko
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	    http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// daemonURL returns the base URL of the running daemon
+func daemonURL() string {
+	return fmt.Sprintf("http://localhost:%d", portSvr)
+}
+
+// exportSnapshot writes the running daemon's registry to the stdout
+func exportSnapshot(args []string) (string, error) {
+
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	format := flags.String("format", "dump", "snapshot format, dump or json")
+	if err := flags.Parse(args); err != nil {
+		return "Usage: " + daemonName + " export [--format dump|json]", err
+	}
+
+	resp, err := http.Get(daemonURL() + "/export?format=" + url.QueryEscape(*format))
+	if err != nil {
+		return "Failed to reach the daemon", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return "Export failed", fmt.Errorf("%s", strings.TrimSpace(string(msg)))
+	}
+
+	_, err = io.Copy(os.Stdout, resp.Body)
+	return "", err
+}
+
+// importSnapshot sends a snapshot from the named file, or from
+// the stdin if none, to the running daemon
+func importSnapshot(args []string) (string, error) {
+
+	usage := "Usage: " + daemonName + " import [--mode merge|replace] [--format dump|json] [file]"
+
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	mode := flags.String("mode", "merge", "merge into or replace the registry")
+	format := flags.String("format", "dump", "snapshot format, dump or json")
+	if err := flags.Parse(args); err != nil {
+		return usage, err
+	}
+
+	var in io.Reader = os.Stdin
+
+	switch flags.NArg() {
+	case 0:
+	case 1:
+		if name := flags.Arg(0); name != "-" {
+			file, err := os.Open(name)
+			if err != nil {
+				return "Failed to open the snapshot", err
+			}
+			defer file.Close()
+			in = file
+		}
+	default:
+		return usage, nil
+	}
+
+	contentType := "text/plain"
+	if *format == "json" {
+		contentType = "application/json"
+	}
+
+	query := url.Values{"mode": {*mode}, "format": {*format}}
+
+	resp, err := http.Post(daemonURL()+"/import?"+query.Encode(), contentType, in)
+	if err != nil {
+		return "Failed to reach the daemon", err
+	}
+	defer resp.Body.Close()
+
+	msg, _ := ioutil.ReadAll(resp.Body)
+
+	if resp.StatusCode != http.StatusOK {
+		os.Stderr.Write(msg)
+		return "Import failed", fmt.Errorf("the daemon replied %q", resp.Status)
+	}
+
+	return strings.TrimSpace(string(msg)), nil
+}
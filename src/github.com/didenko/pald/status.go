@@ -0,0 +1,90 @@
+/*
+	(c) Copyright 2015 Vlad Didenko
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	    http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/didenko/pald/internal/server"
+)
+
+// status combines the service manager's view of the daemon
+// with the daemon's own health and readiness reports
+func status(service *Service) (string, error) {
+
+	report, err := service.Status()
+	if err != nil {
+		return report, err
+	}
+
+	health, err := probe("/healthz")
+	if err != nil {
+		return report + "\nHealth: unreachable", err
+	}
+	report += fmt.Sprintf("\nHealth: %s (pid %d, up %s)", health.Status, health.PID, health.Uptime)
+
+	ready, err := probe("/readyz")
+	if err != nil {
+		return report + "\nReadiness: unknown", err
+	}
+
+	checks := make([]string, 0, len(ready.Checks))
+	for name, check := range ready.Checks {
+		state := "ok"
+		if !check.OK {
+			state = "FAIL"
+		}
+		if check.Detail != "" {
+			state += ", " + check.Detail
+		}
+		checks = append(checks, fmt.Sprintf("%s: %s", name, state))
+	}
+	sort.Strings(checks)
+
+	report += fmt.Sprintf("\nReadiness: %s\n  %s", ready.Status, strings.Join(checks, "\n  "))
+
+	if ready.Status != "ok" {
+		return report, fmt.Errorf("The daemon is not ready")
+	}
+
+	return report, nil
+}
+
+// probe queries a health endpoint of the running daemon
+func probe(path string) (server.Status, error) {
+
+	var st server.Status
+
+	client := http.Client{Timeout: 5 * time.Second}
+
+	resp, err := client.Get(daemonURL() + path)
+	if err != nil {
+		return st, err
+	}
+	defer resp.Body.Close()
+
+	if err = json.NewDecoder(resp.Body).Decode(&st); err != nil {
+		return st, fmt.Errorf("Unexpected %s response: %s", path, err)
+	}
+
+	return st, nil
+}